@@ -0,0 +1,331 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultPath は-configが指定されなかった場合に読み込む設定ファイル
+const DefaultPath = "config.yaml"
+
+type Config struct {
+	Database   DatabaseConfig   `yaml:"database"`
+	S3         S3Config         `yaml:"s3"`
+	CDN        CDNConfig        `yaml:"cdn"`
+	Crawl      CrawlConfig      `yaml:"crawl"`
+	Daemon     DaemonConfig     `yaml:"daemon"`
+	Dates      DatesConfig      `yaml:"dates"`
+	Links      LinksConfig      `yaml:"links"`
+	Similarity SimilarityConfig `yaml:"similarity"`
+	Comments   CommentsConfig   `yaml:"comments"`
+	Images     ImagesConfig     `yaml:"images"`
+}
+
+type DatabaseConfig struct {
+	DSN string `yaml:"dsn"`
+}
+
+type S3Config struct {
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+}
+
+type CDNConfig struct {
+	Host string `yaml:"host"`
+}
+
+type CrawlConfig struct {
+	// 複数プロセスでフィードを分担する場合のシャード番号 (0始まり) とシャード数
+	ShardIndex int `yaml:"shard_index"`
+	ShardCount int `yaml:"shard_count"`
+	// 全体の同時取得数と、同一ホスト (サブドメインはまとめて数える) の同時取得数
+	Workers int `yaml:"workers"`
+	PerHost int `yaml:"per_host"`
+	// 連続失敗したフィードのバックオフ (BackoffBaseから倍々にBackoffMaxまで) と自動無効化までの回数
+	BackoffBase  time.Duration `yaml:"backoff_base"`
+	BackoffMax   time.Duration `yaml:"backoff_max"`
+	DisableAfter int           `yaml:"disable_after"`
+}
+
+// DaemonConfig は常駐モードでの取得間隔の設定
+type DaemonConfig struct {
+	// 取得予定のフィードを確認する間隔
+	Tick time.Duration `yaml:"tick"`
+	// フィードごとの取得間隔の初期値と下限・上限
+	DefaultInterval time.Duration `yaml:"default_interval"`
+	MinInterval     time.Duration `yaml:"min_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+}
+
+// DatesConfig はフィードの日時文字列の解釈方法
+type DatesConfig struct {
+	// gofeedが解釈できなかった日時に順に試すレイアウト (Goの時刻レイアウト形式)。空の場合は既定の一覧を使う
+	Layouts []string `yaml:"layouts"`
+	// タイムゾーンの記載がない日時を解釈するタイムゾーン
+	Timezone string `yaml:"timezone"`
+
+	location *time.Location
+}
+
+// LinksConfig はアイテムのリンクの正規化の設定
+type LinksConfig struct {
+	// 新規アイテムの記事ページを取得し、<link rel="canonical">があればそのURLで保存・重複判定する
+	FetchCanonical bool `yaml:"fetch_canonical"`
+	// 記事ページ取得のタイムアウト
+	FetchTimeout time.Duration `yaml:"fetch_timeout"`
+}
+
+// SimilarityConfig は他サイトに投稿された同じ記事をまとめる条件
+type SimilarityConfig struct {
+	// 公開日時の差がこの範囲内のアイテムのみを比較する
+	Window time.Duration `yaml:"window"`
+	// タイトル・説明文のSimHashと画像の知覚ハッシュ (いずれも64ビット) の違いがこのビット数以下なら同じ記事とみなす
+	TitleDistance int `yaml:"title_distance"`
+	ImageDistance int `yaml:"image_distance"`
+}
+
+// CommentsConfig はコメントフィードのアイテムの扱い
+type CommentsConfig struct {
+	// ignore (保存しない) または store (commentsテーブルへ保存する)。フィードごとの設定が優先する
+	Policy string `yaml:"policy"`
+}
+
+// ImagesConfig はアイテムの代表画像を選ぶ条件
+type ImagesConfig struct {
+	// 幅・高さがこれ未満の画像 (カウンター・絵文字など) は使わない
+	MinWidth  int `yaml:"min_width"`
+	MinHeight int `yaml:"min_height"`
+	// 長辺÷短辺がこれを超える画像 (横長のバナーなど) は使わない
+	MaxAspectRatio float64 `yaml:"max_aspect_ratio"`
+	// 既定の一覧に加えて除外する広告・カウンターなどのホスト。サブドメインも含む
+	BlockedHosts []string `yaml:"blocked_hosts"`
+	// フィードに使える画像がない場合に記事ページを取得し、og:image・twitter:image・本文の画像を探す
+	FetchPage bool `yaml:"fetch_page"`
+	// 記事ページ取得のタイムアウトと読み込む上限 (バイト)
+	PageTimeout  time.Duration `yaml:"page_timeout"`
+	PageMaxBytes int64         `yaml:"page_max_bytes"`
+	// 取得結果はURLごとに保存して再取得しない。取得に失敗したページのみpage_retry経過後に取得し直す
+	PageRetry time.Duration `yaml:"page_retry"`
+	// GIF画像の扱い。animate (アニメーションWebP), still (最初のフレームの静止画), reject (使わない)
+	GIF string `yaml:"gif"`
+	// フレーム数がgif_max_framesを超えるアニメーションは静止画にし、gif_max_bytesを超えるGIFは使わない
+	GIFMaxFrames int   `yaml:"gif_max_frames"`
+	GIFMaxBytes  int64 `yaml:"gif_max_bytes"`
+	// 合成するフレームの画素数の合計 (フレーム数×幅×高さ) の上限。超えるアニメーションやキャンバス1枚でも超えるGIFは、
+	// フレームをデコードする前に使わないと判定する。1画素あたり4バイトのメモリを使う
+	GIFMaxPixels int64 `yaml:"gif_max_pixels"`
+}
+
+// Location はTimezoneを読み込んだ結果を返す。Loadの後に呼び出すこと
+func (d DatesConfig) Location() *time.Location {
+	if d.location == nil {
+		return time.UTC
+	}
+	return d.location
+}
+
+// envOverrides は環境変数と設定項目の対応表。環境変数が設定されていれば設定ファイルの値より優先する
+func (c *Config) envOverrides() map[string]*string {
+	return map[string]*string{
+		"DATABASE_URL":          &c.Database.DSN,
+		"AWS_REGION":            &c.S3.Region,
+		"S3_BUCKET":             &c.S3.Bucket,
+		"AWS_ACCESS_KEY_ID":     &c.S3.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": &c.S3.SecretAccessKey,
+		"CDN_HOST":              &c.CDN.Host,
+	}
+}
+
+// intEnvOverrides は数値の設定項目に対する環境変数の対応表
+func (c *Config) intEnvOverrides() map[string]*int {
+	return map[string]*int{
+		"SHARD_INDEX":    &c.Crawl.ShardIndex,
+		"SHARD_COUNT":    &c.Crawl.ShardCount,
+		"CRAWL_WORKERS":  &c.Crawl.Workers,
+		"CRAWL_PER_HOST": &c.Crawl.PerHost,
+	}
+}
+
+// Load は設定ファイルを読み込み、環境変数で上書きした設定を返す。
+// pathが空の場合はDefaultPathを読み込み、存在しなければ環境変数のみを使用する
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("設定ファイル %s の解析に失敗しました: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+	default:
+		return nil, fmt.Errorf("設定ファイル %s の読み込みに失敗しました: %w", path, err)
+	}
+
+	for name, field := range cfg.envOverrides() {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			*field = v
+		}
+	}
+	for name, field := range cfg.intEnvOverrides() {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("環境変数 %s の値が数値ではありません: %q", name, v)
+			}
+			*field = n
+		}
+	}
+	if cfg.Crawl.ShardCount == 0 {
+		cfg.Crawl.ShardCount = 1
+	}
+	if cfg.Crawl.Workers == 0 {
+		cfg.Crawl.Workers = 32
+	}
+	if cfg.Crawl.PerHost == 0 {
+		cfg.Crawl.PerHost = 2
+	}
+	if cfg.Crawl.BackoffBase == 0 {
+		cfg.Crawl.BackoffBase = 30 * time.Minute
+	}
+	if cfg.Crawl.BackoffMax == 0 {
+		cfg.Crawl.BackoffMax = 48 * time.Hour
+	}
+	if cfg.Crawl.DisableAfter == 0 {
+		cfg.Crawl.DisableAfter = 20
+	}
+	if cfg.Daemon.Tick == 0 {
+		cfg.Daemon.Tick = 30 * time.Second
+	}
+	if cfg.Daemon.DefaultInterval == 0 {
+		cfg.Daemon.DefaultInterval = time.Hour
+	}
+	if cfg.Daemon.MinInterval == 0 {
+		cfg.Daemon.MinInterval = 10 * time.Minute
+	}
+	if cfg.Daemon.MaxInterval == 0 {
+		cfg.Daemon.MaxInterval = 24 * time.Hour
+	}
+	if cfg.Dates.Timezone == "" {
+		cfg.Dates.Timezone = "Asia/Tokyo"
+	}
+	if cfg.Links.FetchTimeout == 0 {
+		cfg.Links.FetchTimeout = 5 * time.Second
+	}
+	if cfg.Similarity.Window == 0 {
+		cfg.Similarity.Window = 72 * time.Hour
+	}
+	if cfg.Similarity.TitleDistance == 0 {
+		cfg.Similarity.TitleDistance = 10
+	}
+	if cfg.Similarity.ImageDistance == 0 {
+		cfg.Similarity.ImageDistance = 6
+	}
+	if cfg.Comments.Policy == "" {
+		cfg.Comments.Policy = "ignore"
+	}
+	if cfg.Images.MinWidth == 0 {
+		cfg.Images.MinWidth = 120
+	}
+	if cfg.Images.MinHeight == 0 {
+		cfg.Images.MinHeight = 80
+	}
+	if cfg.Images.MaxAspectRatio == 0 {
+		cfg.Images.MaxAspectRatio = 3.5
+	}
+	if cfg.Images.PageTimeout == 0 {
+		cfg.Images.PageTimeout = 5 * time.Second
+	}
+	if cfg.Images.PageMaxBytes == 0 {
+		cfg.Images.PageMaxBytes = 1024 * 1024
+	}
+	if cfg.Images.PageRetry == 0 {
+		cfg.Images.PageRetry = 24 * time.Hour
+	}
+	if cfg.Images.GIF == "" {
+		cfg.Images.GIF = "animate"
+	}
+	if cfg.Images.GIFMaxFrames == 0 {
+		cfg.Images.GIFMaxFrames = 100
+	}
+	if cfg.Images.GIFMaxBytes == 0 {
+		cfg.Images.GIFMaxBytes = 5 * 1024 * 1024
+	}
+	if cfg.Images.GIFMaxPixels == 0 {
+		cfg.Images.GIFMaxPixels = 50000000
+	}
+	loc, err := time.LoadLocation(cfg.Dates.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("dates.timezone (%s) を読み込めません: %w", cfg.Dates.Timezone, err)
+	}
+	cfg.Dates.location = loc
+	return cfg, nil
+}
+
+// Validate は必須項目が設定されているかを確認する。
+// withStorageがtrueの場合はS3とCDNの設定も必須とする
+func (c *Config) Validate(withStorage bool) error {
+	var missing []string
+	if c.Database.DSN == "" {
+		missing = append(missing, "database.dsn (DATABASE_URL)")
+	}
+	if withStorage {
+		if c.S3.Region == "" {
+			missing = append(missing, "s3.region (AWS_REGION)")
+		}
+		if c.S3.Bucket == "" {
+			missing = append(missing, "s3.bucket (S3_BUCKET)")
+		}
+		if c.S3.AccessKeyID == "" {
+			missing = append(missing, "s3.access_key_id (AWS_ACCESS_KEY_ID)")
+		}
+		if c.S3.SecretAccessKey == "" {
+			missing = append(missing, "s3.secret_access_key (AWS_SECRET_ACCESS_KEY)")
+		}
+		if c.CDN.Host == "" {
+			missing = append(missing, "cdn.host (CDN_HOST)")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("必須の設定がありません: %s", strings.Join(missing, ", "))
+	}
+	if err := c.Crawl.Validate(); err != nil {
+		return err
+	}
+	if c.Daemon.MinInterval > c.Daemon.MaxInterval {
+		return fmt.Errorf("daemon.min_interval (%s) がdaemon.max_interval (%s) を超えています", c.Daemon.MinInterval, c.Daemon.MaxInterval)
+	}
+	if c.Comments.Policy != "ignore" && c.Comments.Policy != "store" {
+		return fmt.Errorf("comments.policy は ignore または store を指定してください: %q", c.Comments.Policy)
+	}
+	if c.Images.GIF != "animate" && c.Images.GIF != "still" && c.Images.GIF != "reject" {
+		return fmt.Errorf("images.gif は animate, still, reject のいずれかを指定してください: %q", c.Images.GIF)
+	}
+	return nil
+}
+
+// Validate はシャード指定と同時取得数が範囲内かを確認する
+func (c CrawlConfig) Validate() error {
+	if c.ShardCount < 1 {
+		return fmt.Errorf("crawl.shard_count (SHARD_COUNT) は1以上を指定してください: %d", c.ShardCount)
+	}
+	if c.ShardIndex < 0 || c.ShardIndex >= c.ShardCount {
+		return fmt.Errorf("crawl.shard_index (SHARD_INDEX) は0から%dの範囲で指定してください: %d", c.ShardCount-1, c.ShardIndex)
+	}
+	if c.Workers < 1 || c.PerHost < 1 {
+		return fmt.Errorf("crawl.workers と crawl.per_host は1以上を指定してください: %d, %d", c.Workers, c.PerHost)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/similarity"
+	"go-rss-sql/urlnorm"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Cluster は複数のサイトに投稿された同じ内容の記事のまとまり。代表には最も早く公開されたアイテムを使う
+type Cluster struct {
+	ID               uint `gorm:"primaryKey"`
+	RepresentativeID uint
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (Cluster) TableName() string {
+	return "clusters"
+}
+
+// SimilarityPolicy は類似記事とみなす条件
+type SimilarityPolicy struct {
+	// 公開日時がこの範囲内のアイテムのみを比較する
+	Window time.Duration
+	// タイトル・説明文のSimHash、または画像の知覚ハッシュのハミング距離がこの値以下なら類似とみなす
+	TitleDistance int
+	ImageDistance int
+}
+
+// AlsoPosted は同じまとまりに属する他サイトのアイテム
+type AlsoPosted struct {
+	RssID       uint
+	Title       string
+	Link        string
+	PublishedAt time.Time
+	SiteName    string
+	SiteURL     string
+}
+
+// HashValue はハッシュをbigint列に保存できる値にする。0はハッシュなしとしてNULLにする
+func HashValue(hash uint64) *int64 {
+	if hash == 0 {
+		return nil
+	}
+	v := int64(hash)
+	return &v
+}
+
+// clusterRow は類似記事の判定に使うrssesの列
+type clusterRow struct {
+	ID          uint
+	SiteID      uint
+	PublishedAt time.Time
+	TitleHash   *int64
+	ImageHash   *int64
+	ClusterID   *uint
+}
+
+// distance はa, bが類似していればハミング距離を返す。類似していなければ-1を返す
+func (p SimilarityPolicy) distance(a, b *clusterRow) int {
+	best := -1
+	if a.TitleHash != nil && b.TitleHash != nil {
+		if d := similarity.Distance(uint64(*a.TitleHash), uint64(*b.TitleHash)); d <= p.TitleDistance {
+			best = d
+		}
+	}
+	if a.ImageHash != nil && b.ImageHash != nil {
+		if d := similarity.Distance(uint64(*a.ImageHash), uint64(*b.ImageHash)); d <= p.ImageDistance && (best < 0 || d < best) {
+			best = d
+		}
+	}
+	return best
+}
+
+// ClusterItemsByLink は指定したリンクのアイテムを、公開日時の近い他サイトの類似アイテムとまとめる。
+// 戻り値はまとまりに加えたアイテム数
+func ClusterItemsByLink(db *gorm.DB, links []string, policy SimilarityPolicy) (int, error) {
+	if len(links) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, len(links))
+	for i, link := range links {
+		keys[i] = urlnorm.Key(link)
+	}
+	var targets []clusterRow
+	const batchSize = 1000
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var batch []clusterRow
+		err := db.Model(&Rss{}).Select("id", "site_id", "published_at", "title_hash", "image_hash", "cluster_id").
+			Where("link_key IN ? AND cluster_id IS NULL", keys[start:end]).Scan(&batch).Error
+		if err != nil {
+			return 0, fmt.Errorf("failed to load items to cluster: %w", err)
+		}
+		targets = append(targets, batch...)
+	}
+	return clusterItems(db, targets, policy)
+}
+
+// ClusterUnassigned はsince以降に公開されたアイテムのうち、まだまとまりに属していないものを類似アイテムとまとめる。
+// タイトルのSimHashが未計算のアイテムは先に計算する。画像の知覚ハッシュは画像のアップロード時にのみ計算される
+func ClusterUnassigned(db *gorm.DB, since time.Time, policy SimilarityPolicy) (int, error) {
+	if err := backfillTitleHashes(db, since); err != nil {
+		return 0, err
+	}
+	var targets []clusterRow
+	err := db.Model(&Rss{}).Select("id", "site_id", "published_at", "title_hash", "image_hash", "cluster_id").
+		Where("published_at >= ? AND cluster_id IS NULL", since).Scan(&targets).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to load items to cluster: %w", err)
+	}
+	return clusterItems(db, targets, policy)
+}
+
+// backfillTitleHashes はsince以降に公開されたアイテムのうちtitle_hashが未計算のものを計算する
+func backfillTitleHashes(db *gorm.DB, since time.Time) error {
+	var batch []Rss
+	return db.Select("id", "title", "description").Where("published_at >= ? AND title_hash IS NULL", since).
+		FindInBatches(&batch, 1000, func(_ *gorm.DB, _ int) error {
+			return db.Transaction(func(tx *gorm.DB) error {
+				for _, item := range batch {
+					hash := similarity.TextHash(item.Title, item.Description)
+					if hash == 0 {
+						continue
+					}
+					if err := tx.Model(&Rss{}).Where("id = ?", item.ID).Update("title_hash", HashValue(hash)).Error; err != nil {
+						return fmt.Errorf("failed to update title hash: %w", err)
+					}
+				}
+				return nil
+			})
+		}).Error
+}
+
+// clusterGroupSize は1回のクエリで候補を読み込む対象アイテム数の上限。対象ごとにハミング距離の条件を付けるため小さく保つ
+const clusterGroupSize = 32
+
+// clusterItems はtargetsの各アイテムについて、最も類似した他サイトのアイテムを探してまとまりに加える
+func clusterItems(db *gorm.DB, targets []clusterRow, policy SimilarityPolicy) (int, error) {
+	clustered := 0
+	for _, group := range clusterGroups(targets, policy.Window) {
+		n, err := clusterGroup(db, group, policy)
+		clustered += n
+		if err != nil {
+			return clustered, err
+		}
+	}
+	return clustered, nil
+}
+
+// clusterGroups はtargetsを公開日時の順に並べ、前のアイテムとの間隔がwindowの2倍以下の範囲ごと
+// (最大clusterGroupSize件) に分ける
+func clusterGroups(targets []clusterRow, window time.Duration) [][]clusterRow {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].PublishedAt.Before(targets[j].PublishedAt) })
+	var groups [][]clusterRow
+	for start := 0; start < len(targets); {
+		end := start + 1
+		for end < len(targets) && end-start < clusterGroupSize &&
+			targets[end].PublishedAt.Sub(targets[end-1].PublishedAt) <= 2*window {
+			end++
+		}
+		groups = append(groups, targets[start:end])
+		start = end
+	}
+	return groups
+}
+
+// clusterGroup は公開日時の近いtargetsの候補を読み込み、まとまりに加える
+func clusterGroup(db *gorm.DB, targets []clusterRow, policy SimilarityPolicy) (int, error) {
+	rows, err := loadCandidates(db, targets, policy)
+	if err != nil {
+		return 0, err
+	}
+	candidates := make([]*clusterRow, len(rows))
+	byID := make(map[uint]*clusterRow, len(rows))
+	for i := range rows {
+		candidates[i] = &rows[i]
+		byID[rows[i].ID] = &rows[i]
+	}
+
+	clustered := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range targets {
+			target := &targets[i]
+			if row, ok := byID[target.ID]; ok {
+				// 同じ実行中に他のアイテムのまとまりに加わっている場合がある
+				target = row
+			}
+			if target.ClusterID != nil {
+				continue
+			}
+			match := bestMatch(target, candidates, policy)
+			if match == nil {
+				continue
+			}
+			if err := joinCluster(tx, target, match); err != nil {
+				return err
+			}
+			clustered++
+		}
+		return nil
+	})
+	return clustered, err
+}
+
+// loadCandidates はtargetsのいずれかと公開日時がWindow以内で、ハッシュの距離が閾値以下の行を読み込む。
+// 距離はSQLで計算するため、類似していない行は読み込まない。ハッシュを持つ対象がなければ何も読み込まない
+func loadCandidates(db *gorm.DB, targets []clusterRow, policy SimilarityPolicy) ([]clusterRow, error) {
+	filter, args := policy.distanceFilter(targets)
+	if filter == "" {
+		return nil, nil
+	}
+	from := targets[0].PublishedAt.Add(-policy.Window)
+	to := targets[len(targets)-1].PublishedAt.Add(policy.Window)
+
+	var rows []clusterRow
+	err := db.Model(&Rss{}).Select("id", "site_id", "published_at", "title_hash", "image_hash", "cluster_id").
+		Where("published_at BETWEEN ? AND ?", from, to).
+		Where(filter, args...).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cluster candidates: %w", err)
+	}
+	return rows, nil
+}
+
+// hammingSQL はbigint列と値のハミング距離を求める式。bit_countを持たない古いPostgreSQLでも動くよう、
+// XORをbit(64)の文字列にして1の数を数える
+const hammingSQL = "length(replace(((%s # ?)::bit(64))::text, '0', ''))"
+
+// distanceFilter はtargetsのいずれかとのハミング距離がTitleDistance・ImageDistance以下の行に絞り込む条件を返す
+func (p SimilarityPolicy) distanceFilter(targets []clusterRow) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	for _, column := range []struct {
+		name     string
+		distance int
+		hash     func(clusterRow) *int64
+	}{
+		{"title_hash", p.TitleDistance, func(r clusterRow) *int64 { return r.TitleHash }},
+		{"image_hash", p.ImageDistance, func(r clusterRow) *int64 { return r.ImageHash }},
+	} {
+		if column.distance < 0 {
+			continue
+		}
+		seen := make(map[int64]bool)
+		for _, target := range targets {
+			h := column.hash(target)
+			if h == nil || seen[*h] {
+				continue
+			}
+			seen[*h] = true
+			conditions = append(conditions, fmt.Sprintf(hammingSQL, column.name)+" <= ?")
+			args = append(args, *h, column.distance)
+		}
+	}
+	return strings.Join(conditions, " OR "), args
+}
+
+// bestMatch は公開日時がWindow以内の他サイトのアイテムのうち、最も類似したものを返す
+func bestMatch(target *clusterRow, candidates []*clusterRow, policy SimilarityPolicy) *clusterRow {
+	var best *clusterRow
+	bestDistance := -1
+	for _, candidate := range candidates {
+		if candidate.ID == target.ID || candidate.SiteID == target.SiteID {
+			continue
+		}
+		gap := candidate.PublishedAt.Sub(target.PublishedAt)
+		if gap > policy.Window || -gap > policy.Window {
+			continue
+		}
+		d := policy.distance(target, candidate)
+		if d < 0 || (bestDistance >= 0 && d >= bestDistance) {
+			continue
+		}
+		best, bestDistance = candidate, d
+	}
+	return best
+}
+
+// joinCluster はtargetをmatchのまとまりに加える。matchがまとまりに属していなければ新たに作る
+func joinCluster(tx *gorm.DB, target, match *clusterRow) error {
+	if match.ClusterID == nil {
+		representative := match
+		if target.PublishedAt.Before(match.PublishedAt) {
+			representative = target
+		}
+		cluster := Cluster{RepresentativeID: representative.ID}
+		if err := tx.Create(&cluster).Error; err != nil {
+			return fmt.Errorf("failed to create cluster: %w", err)
+		}
+		if err := tx.Model(&Rss{}).Where("id IN ?", []uint{target.ID, match.ID}).Update("cluster_id", cluster.ID).Error; err != nil {
+			return fmt.Errorf("failed to assign cluster: %w", err)
+		}
+		target.ClusterID, match.ClusterID = &cluster.ID, &cluster.ID
+		return nil
+	}
+
+	clusterID := *match.ClusterID
+	if err := tx.Model(&Rss{}).Where("id = ?", target.ID).Update("cluster_id", clusterID).Error; err != nil {
+		return fmt.Errorf("failed to assign cluster: %w", err)
+	}
+	// 代表より早く公開されたアイテムが加わった場合は代表を入れ替える
+	err := tx.Exec(`UPDATE clusters SET representative_id = ?, updated_at = ? WHERE id = ?
+		AND (SELECT published_at FROM rsses WHERE rsses.id = clusters.representative_id) > ?`,
+		target.ID, time.Now(), clusterID, target.PublishedAt).Error
+	if err != nil {
+		return fmt.Errorf("failed to update cluster representative: %w", err)
+	}
+	target.ClusterID = &clusterID
+	return nil
+}
+
+// reassignRepresentatives はdeletedのアイテムを削除する前に、それらを代表とするまとまりの代表を
+// 残るメンバーのうち最も早く公開されたものへ付け替える。deletedはIDの一覧またはIDを返すサブクエリ。
+// 残るメンバーがいないまとまりは代表の削除とともに削除される
+func reassignRepresentatives(tx *gorm.DB, deleted interface{}) error {
+	err := tx.Exec(`UPDATE clusters SET representative_id = remaining.id, updated_at = ?
+		FROM (
+			SELECT DISTINCT ON (r.cluster_id) r.cluster_id, r.id FROM rsses AS r
+			WHERE r.cluster_id IS NOT NULL AND r.deleted_at IS NULL AND r.id NOT IN (?)
+			ORDER BY r.cluster_id, r.published_at, r.id
+		) AS remaining
+		WHERE remaining.cluster_id = clusters.id AND clusters.representative_id IN (?)`,
+		time.Now(), deleted, deleted).Error
+	if err != nil {
+		return fmt.Errorf("failed to reassign cluster representatives: %w", err)
+	}
+	return nil
+}
+
+// AlsoPostedBy は指定したアイテムと同じまとまりに属する他のアイテムを公開日時の順に返す
+func AlsoPostedBy(db *gorm.DB, rssID uint) ([]AlsoPosted, error) {
+	var posted []AlsoPosted
+	err := db.Table("rsses AS r").
+		Select("r.id AS rss_id, r.title, r.link, r.published_at, sites.name AS site_name, sites.url AS site_url").
+		Joins("JOIN rsses AS self ON self.cluster_id = r.cluster_id").
+		Joins("JOIN sites ON sites.id = r.site_id").
+		Where("self.id = ? AND r.id <> self.id AND r.deleted_at IS NULL", rssID).
+		Order("r.published_at").
+		Scan(&posted).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load similar items: %w", err)
+	}
+	return posted, nil
+}
+
+// WhereRepresentative はクエリを、まとまりに属さないアイテムとまとまりの代表のアイテムに絞り込む。
+// 同じ記事を1件として表示するために使う
+func WhereRepresentative(query *gorm.DB) *gorm.DB {
+	return query.Where("rsses.cluster_id IS NULL OR rsses.id IN (?)",
+		query.Session(&gorm.Session{NewDB: true}).Model(&Cluster{}).Select("representative_id"))
+}
@@ -0,0 +1,146 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/urlnorm"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClusterGroups(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := 24 * time.Hour
+	at := func(hours ...int) []clusterRow {
+		rows := make([]clusterRow, len(hours))
+		for i, h := range hours {
+			rows[i] = clusterRow{ID: uint(i + 1), PublishedAt: base.Add(time.Duration(h) * time.Hour)}
+		}
+		return rows
+	}
+	many := make([]int, 70)
+	for i := range many {
+		many[i] = i
+	}
+
+	tests := []struct {
+		name    string
+		targets []clusterRow
+		sizes   []int
+	}{
+		{"empty", nil, nil},
+		{"close together", at(0, 10, 20, 40), []int{4}},
+		{"gap wider than twice the window", at(0, 10, 100, 110), []int{2, 2}},
+		{"unsorted", at(110, 0, 100, 10), []int{2, 2}},
+		{"capped by group size", at(many...), []int{clusterGroupSize, clusterGroupSize, 70 - 2*clusterGroupSize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := clusterGroups(tt.targets, window)
+			var sizes []int
+			for _, group := range groups {
+				sizes = append(sizes, len(group))
+				for i := 1; i < len(group); i++ {
+					if group[i].PublishedAt.Before(group[i-1].PublishedAt) {
+						t.Errorf("group is not sorted by published_at: %v", group)
+					}
+				}
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.sizes) {
+				t.Errorf("group sizes = %v, want %v", sizes, tt.sizes)
+			}
+		})
+	}
+}
+
+func TestDistanceFilter(t *testing.T) {
+	policy := SimilarityPolicy{Window: time.Hour, TitleDistance: 10, ImageDistance: 6}
+	h1, h2, img := int64(1), int64(-2), int64(3)
+
+	tests := []struct {
+		name       string
+		targets    []clusterRow
+		conditions int
+		args       []interface{}
+	}{
+		{"no hashes", []clusterRow{{ID: 1}}, 0, nil},
+		{"title only", []clusterRow{{ID: 1, TitleHash: &h1}}, 1, []interface{}{h1, 10}},
+		{"duplicate hashes", []clusterRow{{ID: 1, TitleHash: &h1}, {ID: 2, TitleHash: &h1}}, 1, []interface{}{h1, 10}},
+		{"title and image", []clusterRow{{ID: 1, TitleHash: &h1, ImageHash: &img}, {ID: 2, TitleHash: &h2}}, 3,
+			[]interface{}{h1, 10, h2, 10, img, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, args := policy.distanceFilter(tt.targets)
+			if got := strings.Count(filter, "<= ?"); got != tt.conditions {
+				t.Errorf("filter %q has %d conditions, want %d", filter, got, tt.conditions)
+			}
+			if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+// TestLoadCandidatesPrunes は公開日時が同じ範囲にある大量の行のうち、ハッシュの距離が閾値以下の行のみを
+// 読み込むことを確かめる。BENCH_DATABASE_URLが未設定の場合はスキップする
+func TestLoadCandidatesPrunes(t *testing.T) {
+	tx, _ := testDB(t)
+	policy := SimilarityPolicy{Window: 72 * time.Hour, TitleDistance: 10, ImageDistance: 6}
+	published := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var sites []Site
+	for i := 0; i < 2; i++ {
+		site := Site{Name: "cluster test", URL: fmt.Sprintf("https://cluster%d.example.com", i)}
+		if err := tx.Create(&site).Error; err != nil {
+			t.Fatal(err)
+		}
+		sites = append(sites, site)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	target := int64(random.Uint64())
+	near := []int64{target ^ 0x1, target ^ 0x3ff, target ^ 0x7fe0000000000000} // 距離1, 10, 10
+	far := target ^ 0x7ff                                                      // 距離11
+
+	var rows []Rss
+	add := func(siteID uint, hash int64) {
+		link := fmt.Sprintf("https://cluster.example.com/items/%d", len(rows))
+		key := urlnorm.Key(link)
+		h := hash
+		rows = append(rows, Rss{Title: link, Link: link, LinkKey: &key, SiteID: siteID, PublishedAt: published, TitleHash: &h})
+	}
+	add(sites[0].ID, target)
+	for _, hash := range near {
+		add(sites[1].ID, hash)
+	}
+	add(sites[1].ID, far)
+	for i := 0; i < 2000; i++ {
+		add(sites[1].ID, int64(random.Uint64()))
+	}
+	if err := tx.CreateInBatches(rows, 500).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []clusterRow{{ID: rows[0].ID, SiteID: sites[0].ID, PublishedAt: published, TitleHash: &target}}
+	candidates, err := loadCandidates(tx, targets, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 対象自身と距離10以下の3件のみ
+	if len(candidates) != 1+len(near) {
+		t.Fatalf("loaded %d candidates out of %d rows, want %d", len(candidates), len(rows), 1+len(near))
+	}
+	if match := bestMatch(&targets[0], toPointers(candidates), policy); match == nil || *match.TitleHash != near[0] {
+		t.Errorf("bestMatch() = %+v, want the row at distance 1", match)
+	}
+}
+
+func toPointers(rows []clusterRow) []*clusterRow {
+	pointers := make([]*clusterRow, len(rows))
+	for i := range rows {
+		pointers[i] = &rows[i]
+	}
+	return pointers
+}
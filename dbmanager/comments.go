@@ -0,0 +1,210 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/urlnorm"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// フィードの種類。コメントフィードのアイテムは記事としてrssesへ保存しない
+const (
+	FeedKindArticle = "article"
+	FeedKindComment = "comment"
+)
+
+// コメントの扱い。フィードごとに指定がなければ設定のcomments.policyを使う
+const (
+	CommentPolicyIgnore = "ignore"
+	CommentPolicyStore  = "store"
+)
+
+// commentLinkPattern はWordPressなどがコメントのリンクに付けるフラグメント・パラメータ
+const commentLinkPattern = `(#comment-[0-9]+|[?&]replytocom=[0-9]+|[?&]comment_id=[0-9]+|[?&]showComment=[0-9]+)`
+
+var commentLink = regexp.MustCompile(commentLinkPattern)
+
+// commentFeedPaths はコメントフィードのURLに含まれるパス (WordPress, Blogger)
+var commentFeedPaths = []string{"/comments/feed", "feed=comments-rss2", "feed=comments-atom", "/feeds/comments/"}
+
+// Comment はコメントフィードのアイテム。記事とは別のテーブルに保存する
+type Comment struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	// コメント先の記事。未保存の記事へのコメントはRssIDがNULLになる
+	SiteID      *uint
+	RssID       *uint
+	Link        string `gorm:"unique"`
+	ParentLink  string
+	Author      string
+	Title       string
+	Content     string
+	PublishedAt time.Time
+}
+
+func (Comment) TableName() string {
+	return "comments"
+}
+
+// CommentRecord はコメントのアイテムと公開日時の組
+type CommentRecord struct {
+	Item        *gofeed.Item
+	PublishedAt time.Time
+}
+
+// FeedKindOf はURLからフィードの種類を推定する
+func FeedKindOf(feedURL string) string {
+	lower := strings.ToLower(feedURL)
+	for _, path := range commentFeedPaths {
+		if strings.Contains(lower, path) {
+			return FeedKindComment
+		}
+	}
+	return FeedKindArticle
+}
+
+// IsCommentItem はアイテムがコメントかを返す。Atomのthr:in-reply-toか、コメント用のリンク・GUIDで判定する
+func IsCommentItem(item *gofeed.Item) bool {
+	if len(item.Extensions["thr"]["in-reply-to"]) > 0 {
+		return true
+	}
+	return commentLink.MatchString(item.Link) || commentLink.MatchString(item.GUID)
+}
+
+// commentParentLink はコメント先の記事のリンクを返す
+func commentParentLink(item *gofeed.Item) string {
+	for _, ext := range item.Extensions["thr"]["in-reply-to"] {
+		if href := ext.Attrs["href"]; href != "" {
+			return urlnorm.Canonicalize(href)
+		}
+	}
+	return urlnorm.Canonicalize(commentLink.ReplaceAllString(item.Link, ""))
+}
+
+// SaveComments はコメントをcommentsテーブルへ保存し、新たに保存した件数を返す。
+// コメント先の記事とサイトが保存済みであれば紐づける
+func SaveComments(db *gorm.DB, siteURL string, records []CommentRecord) (int, error) {
+	var comments []Comment
+	var parentKeys []string
+	seen := make(map[string]bool)
+	for _, record := range records {
+		item := record.Item
+		link := strings.TrimSpace(item.Link)
+		if link == "" || seen[link] {
+			continue
+		}
+		seen[link] = true
+		parent := commentParentLink(item)
+		parentKeys = append(parentKeys, urlnorm.Key(parent))
+		comments = append(comments, Comment{
+			Link:        link,
+			ParentLink:  parent,
+			Author:      itemAuthor(item),
+			Title:       item.Title,
+			Content:     firstNonEmpty(item.Content, item.Description),
+			PublishedAt: record.PublishedAt,
+		})
+	}
+	if len(comments) == 0 {
+		return 0, nil
+	}
+
+	saved := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var site Site
+		if err := tx.Where("url = ?", siteURL).Limit(1).Find(&site).Error; err != nil {
+			return fmt.Errorf("failed to find site: %w", err)
+		}
+		ids, err := itemIDsByKey(tx, parentKeys)
+		if err != nil {
+			return err
+		}
+		for i := range comments {
+			if site.ID != 0 {
+				comments[i].SiteID = &site.ID
+			}
+			if id, ok := ids[urlnorm.Key(comments[i].ParentLink)]; ok {
+				id := id
+				comments[i].RssID = &id
+			}
+		}
+		result := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "link"}}, DoNothing: true}).
+			CreateInBatches(comments, 500)
+		if result.Error != nil {
+			return fmt.Errorf("failed to insert comments: %w", result.Error)
+		}
+		saved = int(result.RowsAffected)
+		return nil
+	})
+	return saved, err
+}
+
+// SetFeedKind はフィードの種類を記録する
+func SetFeedKind(db *gorm.DB, feedURL, kind string) error {
+	if err := db.Model(&Feed{}).Where("url = ?", feedURL).Update("kind", kind).Error; err != nil {
+		return fmt.Errorf("failed to update feed kind: %w", err)
+	}
+	return nil
+}
+
+// SetFeedsCommentPolicy はフィードごとのコメントの扱いを設定する。空文字列は設定の既定値に戻す
+func SetFeedsCommentPolicy(db *gorm.DB, urls []string, policy string) (int, error) {
+	result := db.Model(&Feed{}).Where("url IN ?", urls).Update("comment_policy", policy)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to update comment policy: %w", result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// MoveCommentItems はコメントのリンクを持つrssesの行をcommentsへ移し、移した件数を返す。
+// dryRunがtrueの場合は件数のみを返す
+func MoveCommentItems(db *gorm.DB, dryRun bool) (int, error) {
+	var count int64
+	if err := db.Model(&Rss{}).Unscoped().Where("link ~ ?", commentLinkPattern).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count comment items: %w", err)
+	}
+	if dryRun || count == 0 {
+		return int(count), nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO comments (created_at, site_id, link, parent_link, author, title, content, published_at)
+			SELECT created_at, site_id, link, regexp_replace(link, ?, ''), author, title, description, published_at
+			FROM rsses WHERE link ~ ? ON CONFLICT (link) DO NOTHING`, commentLinkPattern, commentLinkPattern).Error
+		if err != nil {
+			return fmt.Errorf("failed to copy comment items: %w", err)
+		}
+		err = tx.Exec(`UPDATE comments SET rss_id = rsses.id FROM rsses
+			WHERE comments.rss_id IS NULL AND rsses.link = comments.parent_link`).Error
+		if err != nil {
+			return fmt.Errorf("failed to link comments to items: %w", err)
+		}
+		// まとまりの代表を削除してもまとまりごと消えないよう、代表を付け替えてから削除する
+		commentItems := tx.Session(&gorm.Session{NewDB: true}).Table("rsses").Select("id").Where("link ~ ?", commentLinkPattern)
+		if err := reassignRepresentatives(tx, commentItems); err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM rsses WHERE link ~ ?`, commentLinkPattern).Error; err != nil {
+			return fmt.Errorf("failed to delete comment items: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
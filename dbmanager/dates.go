@@ -0,0 +1,86 @@
+package dbmanager
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// DefaultDateLayouts はgofeedが解釈できなかった日時文字列に順に試すレイアウト
+var DefaultDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"2006-01-02",
+	"2006年1月2日 15:04",
+	"2006年1月2日",
+}
+
+// DateParser はフィードアイテムの公開日時を決める
+type DateParser struct {
+	Layouts []string
+	// タイムゾーンの記載がない日時、または未知の略称 (JSTなど) の日時はこのタイムゾーンとして解釈する
+	Location *time.Location
+}
+
+// explicitZone は日時文字列が数値のオフセット、またはUTCを表す表記で終わっているかを判定する
+var explicitZone = regexp.MustCompile(`([+-]\d{2}:?\d{2}|Z|GMT|UTC|UT)$`)
+
+// PublishedAt はアイテムの公開日時を返す。PublishedParsed, UpdatedParsed, 文字列の順に試し、
+// いずれからも得られなかった場合はnowを返してinferredをtrueにする
+func (p DateParser) PublishedAt(item *gofeed.Item, now time.Time) (publishedAt time.Time, inferred bool) {
+	if item.PublishedParsed != nil {
+		return p.localize(*item.PublishedParsed, item.Published), false
+	}
+	if item.UpdatedParsed != nil {
+		return p.localize(*item.UpdatedParsed, item.Updated), false
+	}
+	for _, raw := range []string{item.Published, item.Updated} {
+		if t, ok := p.parse(raw); ok {
+			return t, false
+		}
+	}
+	return now, true
+}
+
+func (p DateParser) location() *time.Location {
+	if p.Location == nil {
+		return time.UTC
+	}
+	return p.Location
+}
+
+func (p DateParser) parse(raw string) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, false
+	}
+	layouts := p.Layouts
+	if len(layouts) == 0 {
+		layouts = DefaultDateLayouts
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, raw, p.location()); err == nil {
+			return p.localize(t, raw), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// localize はタイムゾーンが不明なままUTCとして解釈された日時を、壁時計の時刻はそのままにLocationの日時へ置き換える。
+// タイムゾーンの記載がない日時や、JSTのように解釈できない略称の日時が対象
+func (p DateParser) localize(t time.Time, raw string) time.Time {
+	if _, offset := t.Zone(); offset != 0 || explicitZone.MatchString(strings.TrimSpace(raw)) {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), p.location())
+}
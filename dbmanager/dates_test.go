@@ -0,0 +1,84 @@
+package dbmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestDateParserPublishedAt(t *testing.T) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	parser := DateParser{Location: jst}
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	parsed := func(layout, raw string) *time.Time {
+		v, err := time.Parse(layout, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &v
+	}
+
+	tests := []struct {
+		name     string
+		item     *gofeed.Item
+		want     time.Time
+		inferred bool
+	}{
+		{
+			name: "parsed with offset",
+			item: &gofeed.Item{Published: "Tue, 02 Jan 2024 15:04:05 +0900", PublishedParsed: parsed(time.RFC1123Z, "Tue, 02 Jan 2024 15:04:05 +0900")},
+			want: time.Date(2024, 1, 2, 15, 4, 5, 0, jst),
+		},
+		{
+			name: "parsed with unknown JST abbreviation",
+			item: &gofeed.Item{Published: "Tue, 02 Jan 2024 15:04:05 JST", PublishedParsed: parsed(time.RFC1123, "Tue, 02 Jan 2024 15:04:05 JST")},
+			want: time.Date(2024, 1, 2, 15, 4, 5, 0, jst),
+		},
+		{
+			name: "parsed as UTC",
+			item: &gofeed.Item{Published: "2024-01-02T06:04:05Z", PublishedParsed: parsed(time.RFC3339, "2024-01-02T06:04:05Z")},
+			want: time.Date(2024, 1, 2, 6, 4, 5, 0, time.UTC),
+		},
+		{
+			name: "parsed without zone",
+			item: &gofeed.Item{Published: "2024-01-02 15:04:05", PublishedParsed: parsed("2006-01-02 15:04:05", "2024-01-02 15:04:05")},
+			want: time.Date(2024, 1, 2, 15, 4, 5, 0, jst),
+		},
+		{
+			name: "updated only",
+			item: &gofeed.Item{Updated: "2024-01-03T00:00:00+09:00", UpdatedParsed: parsed(time.RFC3339, "2024-01-03T00:00:00+09:00")},
+			want: time.Date(2024, 1, 3, 0, 0, 0, 0, jst),
+		},
+		{
+			name: "japanese layout",
+			item: &gofeed.Item{Published: "2024年3月4日 12:30"},
+			want: time.Date(2024, 3, 4, 12, 30, 0, 0, jst),
+		},
+		{
+			name: "updated string",
+			item: &gofeed.Item{Published: "unknown", Updated: "2024/03/04 12:30"},
+			want: time.Date(2024, 3, 4, 12, 30, 0, 0, jst),
+		},
+		{
+			name:     "no date",
+			item:     &gofeed.Item{},
+			want:     now,
+			inferred: true,
+		},
+		{
+			name:     "unparsable",
+			item:     &gofeed.Item{Published: "yesterday"},
+			want:     now,
+			inferred: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, inferred := parser.PublishedAt(tt.item, now)
+			if !got.Equal(tt.want) || inferred != tt.inferred {
+				t.Errorf("PublishedAt() = %v, %v, want %v, %v", got, inferred, tt.want, tt.inferred)
+			}
+		})
+	}
+}
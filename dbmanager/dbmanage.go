@@ -1,18 +1,22 @@
 package dbmanager
 
 import (
-	"errors"
 	"fmt"
+	"go-rss-sql/similarity"
+	"go-rss-sql/urlnorm"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/mmcdole/gofeed"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Site struct {
 	gorm.Model
-	Name string `gorm:"unique"`
+	// サイト名はフィードのタイトルのため、別のサイトと同じになることがある
+	Name string `gorm:"index"`
 	URL  string `gorm:"unique"`
 	Rss  []Rss  `gorm:"foreignkey:SiteID"`
 }
@@ -30,89 +34,208 @@ type Rss struct {
 	Description string
 	Imgurl      string
 	Tag         string
+
+	// 公開日時がフィードから得られず、取得時刻で代用したかどうか
+	PublishedAtInferred bool `gorm:"not null;default:false"`
+
+	// リンクが変わっても同じアイテムと判定するための識別子 (サイト内で一意)
+	GUID          string `gorm:"column:guid"`
+	Author        string
+	ItemUpdatedAt *time.Time
+
+	// 重複判定に使う正規化済みのリンク (urlnorm.Key)。一意制約を持つ
+	LinkKey *string
+
+	// 他サイトの類似記事の検出に使うタイトル・説明文のSimHashと画像の知覚ハッシュ。所属する類似記事のまとまり
+	TitleHash *int64
+	ImageHash *int64
+	ClusterID *uint
 }
 
 func (Rss) TableName() string {
 	return "rsses"
 }
 
-func SaveSiteAndFeedItemsToDB(db *gorm.DB, siteName, siteURL string, feed *gofeed.Feed, objectURLs []string) error {
-	db.AutoMigrate(&Site{}, &Rss{})
+// ItemStatus はパイプラインで処理したフィードアイテムの状態
+type ItemStatus int
 
-	var site Site
-	result := db.Where("url = ?", siteURL).First(&site)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		site = Site{
-			Name: siteName,
-			URL:  siteURL,
-		}
-		if err := db.Create(&site).Error; err != nil {
-			return fmt.Errorf("failed to insert new site: %w", err)
-		}
+const (
+	ItemStatusNew         ItemStatus = iota // 新規アイテム。画像をアップロード済み
+	ItemStatusNoImage                       // 新規アイテム。画像が見つからなかった
+	ItemStatusImageFailed                   // 新規アイテム。画像の変換・アップロードに失敗した
+	ItemStatusExisting                      // 既にDBに存在する
+	ItemStatusError                         // 存在確認に失敗したため保存しない
+	ItemStatusSkipped                       // リンクが空、またはフィード内の重複のため保存しない
+)
+
+// ShouldSave はDBへ保存すべき状態かを返す
+func (s ItemStatus) ShouldSave() bool {
+	return s == ItemStatusNew || s == ItemStatusNoImage || s == ItemStatusImageFailed
+}
+
+func (s ItemStatus) String() string {
+	switch s {
+	case ItemStatusNew:
+		return "new"
+	case ItemStatusNoImage:
+		return "no-image"
+	case ItemStatusImageFailed:
+		return "image-failed"
+	case ItemStatusExisting:
+		return "existing"
+	case ItemStatusError:
+		return "error"
+	case ItemStatusSkipped:
+		return "skipped"
 	}
+	return fmt.Sprintf("ItemStatus(%d)", int(s))
+}
+
+// ItemRecord はフィードアイテムと、そのアイテムから処理した画像URL・公開日時の組
+type ItemRecord struct {
+	Item     *gofeed.Item
+	ImageURL string
+	Status   ItemStatus
+	// 保存するリンク。空の場合はItem.Linkを正規化して使う
+	Link string
+	// アップロードした画像の知覚ハッシュ。画像がなければ0
+	ImageHash uint64
+
+	// PublishedAtがゼロ値の場合は保存時刻を使い、推定値として記録する
+	PublishedAt       time.Time
+	PublishedInferred bool
+}
 
-	var rssItems []Rss
-	linksSeen := make(map[string]bool) // リンクの一意性を保証するためのマップ
+// link は保存するアイテムのリンクを返す
+func (r ItemRecord) link() string {
+	if r.Link != "" {
+		return r.Link
+	}
+	return urlnorm.Canonicalize(r.Item.Link)
+}
 
-	for i, item := range feed.Items {
-		publishedAt, err := time.Parse(time.RFC1123, item.Published)
+// SaveSiteAndFeedItems はサイトを登録し、保存対象のレコードをDBへ保存する。
+// 画像URLは各レコードのアイテムにのみ紐づけられる。サイトとアイテムは1つのトランザクションで保存し、
+// 既存のサイト・アイテムとの重複はON CONFLICTで無視するため、再実行や並行実行でも一意制約違反にならない。
+// 戻り値は新たに保存したアイテム数
+func SaveSiteAndFeedItems(db *gorm.DB, siteName, siteURL string, records []ItemRecord) (int, error) {
+	saved := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		site, err := upsertSite(tx, siteName, siteURL)
 		if err != nil {
-			publishedAt = time.Now()
+			return err
 		}
 
-		tags := ""
-		for _, tag := range item.Categories {
-			if tags != "" {
-				tags += ", "
-			}
-			tags += tag
+		rssItems, err := dropKnownItems(tx, site.ID, buildRssRows(site.ID, records))
+		if err != nil {
+			return err
 		}
+		log.Printf("DB保存されるアイテム: %d", len(rssItems))
+		if len(rssItems) == 0 {
+			return nil
+		}
+
+		// linkとlink_keyのどちらの一意制約に触れても挿入しない
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(rssItems, 500)
+		if result.Error != nil {
+			return fmt.Errorf("failed to insert RSS items in batches: %w", result.Error)
+		}
+		saved = int(result.RowsAffected)
 
-		var imgurl string
-		if i < len(objectURLs) {
-			imgurl = objectURLs[i]
-		} else {
-			imgurl = ""
+		// ON CONFLICTで挿入されなかった行にはIDが返らないため、リンクのキーから引き直す
+		keys := make([]string, len(rssItems))
+		for i, rss := range rssItems {
+			keys[i] = *rss.LinkKey
+		}
+		ids, err := itemIDsByKey(tx, keys)
+		if err != nil {
+			return err
+		}
+		if err := saveItemDetails(tx, ids, records); err != nil {
+			return err
 		}
 
-		var rss Rss
-		result := db.Where("link = ?", item.Link).First(&rss)
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			if _, exists := linksSeen[item.Link]; !exists { // 重複チェック
-				rss = Rss{
-					Title:       item.Title,
-					Link:        item.Link,
-					PublishedAt: publishedAt,
-					SiteID:      site.ID,
-					Description: item.Description,
-					Imgurl:      imgurl,
-					Tag:         tags,
-				}
-				rssItems = append(rssItems, rss)
-				linksSeen[item.Link] = true // マップにリンクを追加
+		tagsByKey := make(map[string][]string, len(rssItems))
+		for _, record := range records {
+			if record.Item == nil || !record.Status.ShouldSave() {
+				continue
+			}
+			if tags := NormalizeTags(record.Item.Categories); len(tags) > 0 {
+				tagsByKey[urlnorm.Key(record.link())] = tags
 			}
 		}
+		return attachTags(tx, ids, tagsByKey)
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	numBatches := len(rssItems) / 500
-	if len(rssItems)%500 != 0 {
-		numBatches++
+	log.Printf("データベースに保存されたアイテム数: %d", saved) // データベースに保存した後のログメッセージ
+	return saved, nil
+}
+
+// upsertSite はURLでサイトを登録し、既に存在する場合はそのサイトを返す。
+// 同じURLのサイトが論理削除されていれば、削除を取り消して使う
+func upsertSite(tx *gorm.DB, siteName, siteURL string) (Site, error) {
+	site := Site{Name: siteName, URL: siteURL}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "url"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"deleted_at": nil, "updated_at": time.Now()}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "sites.deleted_at IS NOT NULL"}}},
+	}).Create(&site).Error
+	if err != nil {
+		return Site{}, fmt.Errorf("failed to insert new site: %w", err)
 	}
-	log.Printf("Number of batches: %d", numBatches)
 
-	// デバッグ用：rssItemsの内容をログに出力
-	log.Printf("DB保存されるアイテム: %d", len(rssItems))
-	for _, rssItem := range rssItems {
-		log.Printf("Title: %s, Link: %s", rssItem.Title, rssItem.Link)
+	var existing Site
+	result := tx.Where("url = ?", siteURL).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return Site{}, fmt.Errorf("failed to find site: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return Site{}, fmt.Errorf("site %q was not found after upsert", siteURL)
 	}
+	return existing, nil
+}
+
+// buildRssRows は保存対象のレコードをRss行に変換する。正規化したリンクが同じアイテムは最初の1件のみ残す
+func buildRssRows(siteID uint, records []ItemRecord) []Rss {
+	var rows []Rss
+	keysSeen := make(map[string]bool) // リンクの一意性を保証するためのマップ
 
-	if len(rssItems) > 0 {
-		if err := db.CreateInBatches(rssItems, 500).Error; err != nil {
-			return fmt.Errorf("failed to insert RSS items in batches: %w", err)
+	for _, record := range records {
+		item := record.Item
+		if item == nil || !record.Status.ShouldSave() || item.Link == "" {
+			continue
 		}
-		log.Printf("データベースに保存されたアイテム数: %d", len(rssItems)) // データベースに保存した後のログメッセージ
-	}
+		link := record.link()
+		key := urlnorm.Key(link)
+		if keysSeen[key] {
+			continue
+		}
+		keysSeen[key] = true
 
-	return nil
+		publishedAt, inferred := record.PublishedAt, record.PublishedInferred
+		if publishedAt.IsZero() {
+			publishedAt, inferred = time.Now(), true
+		}
 
+		rows = append(rows, Rss{
+			Title:               item.Title,
+			Link:                link,
+			PublishedAt:         publishedAt,
+			PublishedAtInferred: inferred,
+			SiteID:              siteID,
+			Description:         item.Description,
+			Imgurl:              record.ImageURL,
+			Tag:                 strings.Join(item.Categories, ", "),
+			GUID:                strings.TrimSpace(item.GUID),
+			Author:              itemAuthor(item),
+			ItemUpdatedAt:       item.UpdatedParsed,
+			LinkKey:             &key,
+			TitleHash:           HashValue(similarity.TextHash(item.Title, item.Description)),
+			ImageHash:           HashValue(record.ImageHash),
+		})
+	}
+	return rows
 }
@@ -0,0 +1,60 @@
+package dbmanager
+
+import (
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestBuildRssRows(t *testing.T) {
+	item := func(link string) *gofeed.Item {
+		return &gofeed.Item{Title: "title " + link, Link: link}
+	}
+
+	records := []ItemRecord{
+		{Item: item("https://example.com/new"), ImageURL: "https://cdn.example.com/new.webp", Status: ItemStatusNew},
+		{Item: item("https://example.com/existing"), ImageURL: "https://cdn.example.com/existing.webp", Status: ItemStatusExisting},
+		{Item: item("https://example.com/no-image"), Status: ItemStatusNoImage},
+		{Item: item("https://example.com/image-failed"), Status: ItemStatusImageFailed},
+		{Item: item("https://example.com/error"), ImageURL: "https://cdn.example.com/error.webp", Status: ItemStatusError},
+		{Item: item("https://example.com/skipped"), Status: ItemStatusSkipped},
+		{Item: item("https://example.com/new?utm_source=feed"), ImageURL: "https://cdn.example.com/duplicate.webp", Status: ItemStatusNew},
+		{Item: item(""), ImageURL: "https://cdn.example.com/empty.webp", Status: ItemStatusNew},
+		{Item: nil, Status: ItemStatusNew},
+	}
+
+	tests := []struct {
+		link   string
+		imgurl string
+	}{
+		{"https://example.com/new", "https://cdn.example.com/new.webp"},
+		{"https://example.com/no-image", ""},
+		{"https://example.com/image-failed", ""},
+	}
+
+	rows := buildRssRows(7, records)
+	if len(rows) != len(tests) {
+		t.Fatalf("got %d rows, want %d: %+v", len(rows), len(tests), rows)
+	}
+	for i, tt := range tests {
+		row := rows[i]
+		if row.Link != tt.link {
+			t.Errorf("rows[%d].Link = %q, want %q", i, row.Link, tt.link)
+		}
+		if row.Imgurl != tt.imgurl {
+			t.Errorf("rows[%d] (%s).Imgurl = %q, want %q", i, row.Link, row.Imgurl, tt.imgurl)
+		}
+		if row.Title != "title "+tt.link {
+			t.Errorf("rows[%d].Title = %q, want the title of %s", i, row.Title, tt.link)
+		}
+		if row.SiteID != 7 {
+			t.Errorf("rows[%d].SiteID = %d, want 7", i, row.SiteID)
+		}
+		if row.LinkKey == nil || *row.LinkKey == "" {
+			t.Errorf("rows[%d].LinkKey is empty", i)
+		}
+		if !row.PublishedAtInferred || row.PublishedAt.IsZero() {
+			t.Errorf("rows[%d] should fall back to an inferred published time", i)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/urlnorm"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// DedupeResult はリンクのキーの再計算結果
+type DedupeResult struct {
+	Items   int // 対象のアイテム数
+	Rekeyed int // キーが変わったアイテム数
+	Merged  int // 重複として統合し削除したアイテム数
+}
+
+// linkKeyRow はキーの再計算に使うrssesの列
+type linkKeyRow struct {
+	ID      uint
+	Link    string
+	LinkKey *string
+	Imgurl  string
+}
+
+// RebuildLinkKeys は全アイテムのlink_keyを現在の正規化ルールで計算し直し、キーが同じになったアイテムを
+// 最も古いアイテムへ統合する。統合ではタグ・本文・添付ファイル・画像URL・コメントを引き継いでから重複を削除する。
+// 論理削除済みのアイテムは対象にしない。dryRunがtrueの場合は件数のみを返し、DBは変更しない
+func RebuildLinkKeys(db *gorm.DB, dryRun bool) (DedupeResult, error) {
+	var result DedupeResult
+	var rows []linkKeyRow
+	if err := db.Model(&Rss{}).Select("id", "link", "link_key", "imgurl").Order("id").Scan(&rows).Error; err != nil {
+		return result, fmt.Errorf("failed to load item links: %w", err)
+	}
+	result.Items = len(rows)
+
+	keepers := make(map[string]linkKeyRow)
+	duplicates := make(map[uint][]linkKeyRow)
+	newKeys := make(map[uint]string)
+	for _, row := range rows {
+		if strings.TrimSpace(row.Link) == "" {
+			continue
+		}
+		key := urlnorm.Key(row.Link)
+		keeper, ok := keepers[key]
+		if ok {
+			duplicates[keeper.ID] = append(duplicates[keeper.ID], row)
+			result.Merged++
+			continue
+		}
+		keepers[key] = row
+		if row.LinkKey == nil || *row.LinkKey != key {
+			newKeys[row.ID] = key
+			result.Rekeyed++
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// add_rss_link_keyのマイグレーションから呼ばれた時点ではcomments, clustersテーブルがまだない
+		tables := mergeTables{
+			comments: tx.Migrator().HasTable(&Comment{}),
+			clusters: tx.Migrator().HasTable(&Cluster{}),
+		}
+		for keeperID, dups := range duplicates {
+			for _, dup := range dups {
+				if err := mergeItem(tx, keeperID, dup, tables); err != nil {
+					return err
+				}
+			}
+		}
+		return updateLinkKeys(tx, newKeys)
+	})
+	return result, err
+}
+
+// mergeTables は統合時に関連データを移す、後のマイグレーションで作られるテーブルの有無
+type mergeTables struct {
+	comments bool
+	clusters bool
+}
+
+// mergeItem は重複アイテムdupの関連データをkeeperIDのアイテムへ移し、dupを削除する。
+// dupが類似記事のまとまりに属していれば、keeperがまとまりに属していない場合に限り引き継ぐ
+func mergeItem(tx *gorm.DB, keeperID uint, dup linkKeyRow, tables mergeTables) error {
+	type step struct {
+		stmt string
+		args []interface{}
+	}
+	steps := []step{
+		{`INSERT INTO rss_tags (rss_id, tag_id) SELECT ?, tag_id FROM rss_tags WHERE rss_id = ? ON CONFLICT DO NOTHING`, []interface{}{keeperID, dup.ID}},
+		{`INSERT INTO rss_contents (rss_id, content) SELECT ?, content FROM rss_contents WHERE rss_id = ? ON CONFLICT DO NOTHING`, []interface{}{keeperID, dup.ID}},
+		{`UPDATE rss_enclosures SET rss_id = ? WHERE rss_id = ? AND url NOT IN (SELECT url FROM rss_enclosures WHERE rss_id = ?)`, []interface{}{keeperID, dup.ID, keeperID}},
+		{`UPDATE rsses SET imgurl = ? WHERE id = ? AND COALESCE(imgurl, '') = ''`, []interface{}{dup.Imgurl, keeperID}},
+	}
+	if tables.comments {
+		steps = append(steps, step{`UPDATE comments SET rss_id = ? WHERE rss_id = ?`, []interface{}{keeperID, dup.ID}})
+	}
+	if tables.clusters {
+		steps = append(steps, step{`UPDATE rsses SET cluster_id = (SELECT cluster_id FROM rsses WHERE id = ?) WHERE id = ? AND cluster_id IS NULL`, []interface{}{dup.ID, keeperID}})
+	}
+	for _, step := range steps {
+		if err := tx.Exec(step.stmt, step.args...).Error; err != nil {
+			return fmt.Errorf("failed to merge item %d into %d: %w", dup.ID, keeperID, err)
+		}
+	}
+	if tables.clusters {
+		if err := reassignRepresentatives(tx, []uint{dup.ID}); err != nil {
+			return err
+		}
+	}
+	if err := tx.Exec(`DELETE FROM rsses WHERE id = ?`, dup.ID).Error; err != nil {
+		return fmt.Errorf("failed to merge item %d into %d: %w", dup.ID, keeperID, err)
+	}
+	return nil
+}
+
+// updateLinkKeys はlink_keyを更新する。更新途中に一意制約へ触れないよう、一度NULLにしてから設定する。
+// 論理削除済みのアイテムが同じキーを持っていれば、そのキーも外す
+func updateLinkKeys(tx *gorm.DB, keys map[uint]string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+
+	const batchSize = 1000
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := tx.Exec(`UPDATE rsses SET link_key = NULL WHERE id IN ?`, ids[start:end]).Error; err != nil {
+			return fmt.Errorf("failed to clear link keys: %w", err)
+		}
+		batchKeys := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			batchKeys = append(batchKeys, keys[id])
+		}
+		err := tx.Exec(`UPDATE rsses SET link_key = NULL WHERE deleted_at IS NOT NULL AND link_key IN ?`, batchKeys).Error
+		if err != nil {
+			return fmt.Errorf("failed to clear link keys of deleted items: %w", err)
+		}
+	}
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 2*(end-start))
+		for _, id := range ids[start:end] {
+			values = append(values, "(?::bigint, ?::text)")
+			args = append(args, id, keys[id])
+		}
+		stmt := `UPDATE rsses SET link_key = v.key FROM (VALUES ` + strings.Join(values, ", ") + `) AS v(id, key) WHERE rsses.id = v.id`
+		if err := tx.Exec(stmt, args...).Error; err != nil {
+			return fmt.Errorf("failed to update link keys: %w", err)
+		}
+	}
+	return nil
+}
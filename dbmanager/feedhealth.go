@@ -0,0 +1,99 @@
+package dbmanager
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// HealthPolicy は取得に失敗したフィードのバックオフと自動無効化の設定
+type HealthPolicy struct {
+	// 連続失敗がこの回数に達したフィードを無効にする (0の場合は無効化しない)
+	DisableAfter int
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+}
+
+// Backoff は連続失敗回数に応じた次回取得までの待ち時間を返す
+func (p HealthPolicy) Backoff(failures int) time.Duration {
+	if failures <= 0 || p.BackoffBase <= 0 {
+		return 0
+	}
+	d := p.BackoffBase
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if p.BackoffMax > 0 && d >= p.BackoffMax {
+			return p.BackoffMax
+		}
+	}
+	return d
+}
+
+// InBackoff はフィードがバックオフ中で今回の取得を見送るべきかを返す
+func (f Feed) InBackoff(now time.Time) bool {
+	return f.NextAttemptAt != nil && now.Before(*f.NextAttemptAt)
+}
+
+// RecordFeedSuccess は取得成功を記録し、失敗回数をリセットする
+func RecordFeedSuccess(db *gorm.DB, feedURL string, status int) error {
+	now := time.Now()
+	err := db.Model(&Feed{}).Where("url = ?", feedURL).Updates(map[string]interface{}{
+		"consecutive_failures": 0,
+		"last_error":           "",
+		"last_status":          status,
+		"last_success_at":      now,
+		"next_attempt_at":      nil,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to record feed success: %w", err)
+	}
+	return nil
+}
+
+// RecordFeedFailure は取得失敗を記録し、次回の取得時刻を遅らせる。
+// 連続失敗が閾値に達した場合はフィードを無効にし、trueを返す
+func RecordFeedFailure(db *gorm.DB, feedURL string, status int, fetchErr error, policy HealthPolicy) (bool, error) {
+	disabled := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var feed Feed
+		result := tx.Where("url = ?", feedURL).Limit(1).Find(&feed)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil // 未登録のフィード
+		}
+
+		now := time.Now()
+		failures := feed.ConsecutiveFailures + 1
+		next := now.Add(policy.Backoff(failures))
+		updates := map[string]interface{}{
+			"consecutive_failures": failures,
+			"last_error":           fetchErr.Error(),
+			"last_status":          status,
+			"next_attempt_at":      next,
+		}
+		if policy.DisableAfter > 0 && failures >= policy.DisableAfter && feed.Enabled {
+			updates["enabled"] = false
+			updates["auto_disabled_at"] = now
+			disabled = true
+		}
+		return tx.Model(&feed).Updates(updates).Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record feed failure: %w", err)
+	}
+	return disabled, nil
+}
+
+// GetUnhealthyFeeds は取得に失敗しているフィードと自動で無効化されたフィードを失敗回数の多い順に返す
+func GetUnhealthyFeeds(db *gorm.DB) ([]Feed, error) {
+	var feeds []Feed
+	err := db.Where("consecutive_failures > 0 OR auto_disabled_at IS NOT NULL").
+		Order("consecutive_failures desc, id").Find(&feeds).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load unhealthy feeds: %w", err)
+	}
+	return feeds, nil
+}
@@ -0,0 +1,272 @@
+package dbmanager
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Feed はクロール対象のフィードを管理するレコード
+type Feed struct {
+	gorm.Model
+	URL      string `gorm:"unique;not null"`
+	SiteLink string
+	Enabled  bool `gorm:"not null"`
+	Notes    string
+
+	// 条件付きGET用に前回のレスポンスから保存する値
+	ETag         string `gorm:"column:etag"`
+	LastModified string
+
+	// 取得状況。失敗が続くフィードはNextAttemptAtまで取得を見送る
+	ConsecutiveFailures int `gorm:"not null;default:0"`
+	LastError           string
+	LastStatus          int
+	LastSuccessAt       *time.Time
+	NextAttemptAt       *time.Time
+	AutoDisabledAt      *time.Time
+
+	// 常駐モードでの取得間隔と次回の取得予定時刻
+	PollIntervalSeconds int
+	NextPollAt          *time.Time `gorm:"index"`
+
+	// フィードの種類 (FeedKindArticle / FeedKindComment) と、コメントの扱い。CommentPolicyが空なら設定の既定値を使う
+	Kind          string `gorm:"not null;default:article"`
+	CommentPolicy string `gorm:"not null;default:''"`
+
+	// サイトのグループ。OPMLのフォルダの階層を"/"で連結したもの
+	Group string `gorm:"column:feed_group;not null;default:''"`
+}
+
+// FeedImport はOPMLなどから取り込むフィード
+type FeedImport struct {
+	URL     string
+	Group   string
+	Enabled bool
+}
+
+func (Feed) TableName() string {
+	return "feeds"
+}
+
+// GetEnabledFeeds は有効なフィードをID順に返す
+func GetEnabledFeeds(db *gorm.DB) ([]Feed, error) {
+	var feeds []Feed
+	if err := db.Where("enabled = ?", true).Order("id").Find(&feeds).Error; err != nil {
+		return nil, fmt.Errorf("failed to load enabled feeds: %w", err)
+	}
+	return feeds, nil
+}
+
+// GetEnabledFeedURLs は有効なフィードのURLのみを返す
+func GetEnabledFeedURLs(db *gorm.DB) ([]string, error) {
+	feeds, err := GetEnabledFeeds(db)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, len(feeds))
+	for i, feed := range feeds {
+		urls[i] = feed.URL
+	}
+	return urls, nil
+}
+
+// GetFeedsByURLs は指定したURLのフィードを返す。未登録のURLは未保存のFeedとして含める
+func GetFeedsByURLs(db *gorm.DB, urls []string) ([]Feed, error) {
+	var found []Feed
+	if err := db.Where("url IN ?", urls).Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("failed to load feeds: %w", err)
+	}
+	byURL := make(map[string]Feed, len(found))
+	for _, feed := range found {
+		byURL[feed.URL] = feed
+	}
+	feeds := make([]Feed, len(urls))
+	for i, url := range urls {
+		feed, ok := byURL[url]
+		if !ok {
+			feed = Feed{URL: url, Enabled: true, Kind: FeedKindOf(url)}
+		}
+		feeds[i] = feed
+	}
+	return feeds, nil
+}
+
+// ImportFeedURLs は既存のURLを無視しつつフィードを登録し、新規に追加した件数を返す
+func ImportFeedURLs(db *gorm.DB, urls []string) (int, error) {
+	var feeds []Feed
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		url = strings.TrimSpace(url)
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		feeds = append(feeds, Feed{URL: url, Enabled: true, Kind: FeedKindOf(url)})
+	}
+	if len(feeds) == 0 {
+		return 0, nil
+	}
+
+	result := db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "url"}}, DoNothing: true}).
+		CreateInBatches(feeds, 500)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to import feeds: %w", result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// ImportFeeds はフィードをグループ・有効状態とともに登録する。登録済みのフィードはグループが未設定の場合のみ
+// グループを設定し、有効状態は変更しない。戻り値は新規に追加した件数とグループを設定した既存のフィードの件数
+func ImportFeeds(db *gorm.DB, imports []FeedImport) (added, grouped int, err error) {
+	var feeds []Feed
+	seen := make(map[string]bool)
+	for _, imp := range imports {
+		url := strings.TrimSpace(imp.URL)
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		feeds = append(feeds, Feed{URL: url, Enabled: imp.Enabled, Kind: FeedKindOf(url), Group: imp.Group})
+	}
+	if len(feeds) == 0 {
+		return 0, 0, nil
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "url"}}, DoNothing: true}).
+			CreateInBatches(feeds, 500)
+		if result.Error != nil {
+			return fmt.Errorf("failed to import feeds: %w", result.Error)
+		}
+		added = int(result.RowsAffected)
+
+		for _, feed := range feeds {
+			if feed.Group == "" {
+				continue
+			}
+			result := tx.Model(&Feed{}).Where("url = ? AND feed_group = ''", feed.URL).Update("feed_group", feed.Group)
+			if result.Error != nil {
+				return fmt.Errorf("failed to update feed group: %w", result.Error)
+			}
+			grouped += int(result.RowsAffected)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, grouped, nil
+}
+
+// SeedFeedsIfEmpty はfeedsテーブルが空の場合のみ、与えられたURLで初期登録を行う
+func SeedFeedsIfEmpty(db *gorm.DB, urls []string) (int, error) {
+	var count int64
+	if err := db.Model(&Feed{}).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count feeds: %w", err)
+	}
+	if count > 0 {
+		return 0, nil
+	}
+	return ImportFeedURLs(db, urls)
+}
+
+// UpdateFeedSiteLink はフィード取得時に判明したサイトのリンクを記録する
+func UpdateFeedSiteLink(db *gorm.DB, feedURL, siteLink string) error {
+	if siteLink == "" {
+		return nil
+	}
+	err := db.Model(&Feed{}).Where("url = ? AND site_link <> ?", feedURL, siteLink).
+		Update("site_link", siteLink).Error
+	if err != nil {
+		return fmt.Errorf("failed to update site link: %w", err)
+	}
+	return nil
+}
+
+// ListFeeds は登録済みのフィードをID順に返す
+func ListFeeds(db *gorm.DB) ([]Feed, error) {
+	var feeds []Feed
+	if err := db.Order("id").Find(&feeds).Error; err != nil {
+		return nil, fmt.Errorf("failed to list feeds: %w", err)
+	}
+	return feeds, nil
+}
+
+// RemoveFeeds はフィードを削除する。再登録できるように物理削除を行う
+func RemoveFeeds(db *gorm.DB, urls []string) (int, error) {
+	result := db.Unscoped().Where("url IN ?", urls).Delete(&Feed{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to remove feeds: %w", result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// SetFeedsEnabled はフィードの有効・無効を切り替える。有効にする場合は失敗履歴もリセットする
+func SetFeedsEnabled(db *gorm.DB, urls []string, enabled bool) (int, error) {
+	updates := map[string]interface{}{"enabled": enabled}
+	if enabled {
+		updates["consecutive_failures"] = 0
+		updates["next_attempt_at"] = nil
+		updates["auto_disabled_at"] = nil
+	}
+	result := db.Model(&Feed{}).Where("url IN ?", urls).Updates(updates)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to update feeds: %w", result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// UpdateFeedValidators は次回の条件付きGETに使うETagとLast-Modifiedを保存する
+func UpdateFeedValidators(db *gorm.DB, feedURL, etag, lastModified string) error {
+	err := db.Model(&Feed{}).Where("url = ?", feedURL).
+		Updates(map[string]interface{}{"etag": etag, "last_modified": lastModified}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update feed validators: %w", err)
+	}
+	return nil
+}
+
+// ScheduleFeed は取得間隔と次回の取得予定時刻を保存する
+func ScheduleFeed(db *gorm.DB, feedURL string, interval time.Duration) error {
+	err := db.Model(&Feed{}).Where("url = ?", feedURL).Updates(map[string]interface{}{
+		"poll_interval_seconds": int(interval / time.Second),
+		"next_poll_at":          time.Now().Add(interval),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to schedule feed: %w", err)
+	}
+	return nil
+}
+
+// GetDueFeeds は取得予定時刻を過ぎ、バックオフ中でもない有効なフィードを予定時刻順に返す
+func GetDueFeeds(db *gorm.DB, now time.Time) ([]Feed, error) {
+	var feeds []Feed
+	err := db.Where("enabled = ?", true).
+		Where("next_poll_at IS NULL OR next_poll_at <= ?", now).
+		Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now).
+		Order("next_poll_at NULLS FIRST, id").Find(&feeds).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load due feeds: %w", err)
+	}
+	return feeds, nil
+}
+
+// SiteNamesByURL はサイトのURLとサイト名の対応を返す
+func SiteNamesByURL(db *gorm.DB, urls []string) (map[string]string, error) {
+	names := make(map[string]string, len(urls))
+	if len(urls) == 0 {
+		return names, nil
+	}
+	var sites []Site
+	if err := db.Select("name", "url").Where("url IN ?", urls).Find(&sites).Error; err != nil {
+		return nil, fmt.Errorf("failed to load site names: %w", err)
+	}
+	for _, site := range sites {
+		names[site.URL] = site.Name
+	}
+	return names, nil
+}
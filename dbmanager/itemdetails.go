@@ -0,0 +1,133 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/urlnorm"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RssContent はアイテムの本文。rssesを細く保つため別テーブルに置く
+type RssContent struct {
+	RssID   uint `gorm:"primaryKey;autoIncrement:false"`
+	Content string
+}
+
+func (RssContent) TableName() string {
+	return "rss_contents"
+}
+
+// RssEnclosure はアイテムの添付ファイル
+type RssEnclosure struct {
+	ID     uint `gorm:"primaryKey"`
+	RssID  uint `gorm:"not null"`
+	URL    string
+	Type   string
+	Length int64
+}
+
+func (RssEnclosure) TableName() string {
+	return "rss_enclosures"
+}
+
+// itemAuthor はアイテムの著者名を返す。名前がなければメールアドレスを使う
+func itemAuthor(item *gofeed.Item) string {
+	author := item.Author
+	if author == nil && len(item.Authors) > 0 {
+		author = item.Authors[0]
+	}
+	if author == nil {
+		return ""
+	}
+	if author.Name != "" {
+		return author.Name
+	}
+	return author.Email
+}
+
+// itemIDsByKey はリンクのキー (urlnorm.Key) に対応するアイテムのIDを返す
+func itemIDsByKey(tx *gorm.DB, keys []string) (map[string]uint, error) {
+	ids := make(map[string]uint, len(keys))
+	if len(keys) == 0 {
+		return ids, nil
+	}
+	var items []Rss
+	if err := tx.Select("id", "link_key").Where("link_key IN ?", keys).Find(&items).Error; err != nil {
+		return nil, fmt.Errorf("failed to load item ids: %w", err)
+	}
+	for _, item := range items {
+		if item.LinkKey != nil {
+			ids[*item.LinkKey] = item.ID
+		}
+	}
+	return ids, nil
+}
+
+// saveItemDetails はアイテムの本文と添付ファイルを保存する。既に保存済みのものは無視する
+func saveItemDetails(tx *gorm.DB, ids map[string]uint, records []ItemRecord) error {
+	var contents []RssContent
+	var enclosures []RssEnclosure
+	for _, record := range records {
+		item := record.Item
+		if item == nil || !record.Status.ShouldSave() {
+			continue
+		}
+		id, ok := ids[urlnorm.Key(record.link())]
+		if !ok {
+			continue
+		}
+		if strings.TrimSpace(item.Content) != "" {
+			contents = append(contents, RssContent{RssID: id, Content: item.Content})
+		}
+		for _, enclosure := range item.Enclosures {
+			if enclosure == nil || enclosure.URL == "" {
+				continue
+			}
+			length, _ := strconv.ParseInt(enclosure.Length, 10, 64)
+			enclosures = append(enclosures, RssEnclosure{RssID: id, URL: enclosure.URL, Type: enclosure.Type, Length: length})
+		}
+	}
+
+	if len(contents) > 0 {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(contents, 200).Error
+		if err != nil {
+			return fmt.Errorf("failed to insert item contents: %w", err)
+		}
+	}
+	if len(enclosures) > 0 {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(enclosures, 500).Error
+		if err != nil {
+			return fmt.Errorf("failed to insert item enclosures: %w", err)
+		}
+	}
+	return nil
+}
+
+// StoredItem は保存済みのアイテムを本文・添付ファイルとともにgofeed.Itemとして組み立てる。画像の再抽出に使う
+func StoredItem(db *gorm.DB, rss Rss) (*gofeed.Item, error) {
+	item := &gofeed.Item{Title: rss.Title, Link: rss.Link, Description: rss.Description, GUID: rss.GUID}
+
+	var content RssContent
+	err := db.Where("rss_id = ?", rss.ID).Limit(1).Find(&content).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load item content: %w", err)
+	}
+	item.Content = content.Content
+
+	var enclosures []RssEnclosure
+	if err := db.Where("rss_id = ?", rss.ID).Order("id").Find(&enclosures).Error; err != nil {
+		return nil, fmt.Errorf("failed to load item enclosures: %w", err)
+	}
+	for _, enclosure := range enclosures {
+		item.Enclosures = append(item.Enclosures, &gofeed.Enclosure{
+			URL:    enclosure.URL,
+			Type:   enclosure.Type,
+			Length: strconv.FormatInt(enclosure.Length, 10),
+		})
+	}
+	return item, nil
+}
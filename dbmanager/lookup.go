@@ -0,0 +1,138 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/urlnorm"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// ItemRef は存在確認に使うアイテムのリンクとGUID
+type ItemRef struct {
+	Link string
+	GUID string
+}
+
+// KnownItems はDBに既に存在するアイテムの集合。リンクのキーと、同じサイト内のGUIDで判定する
+type KnownItems struct {
+	keys  map[string]bool
+	guids map[string]bool
+}
+
+// Contains はリンク、または同じサイト内のGUIDが一致するアイテムが存在するかを返す
+func (k KnownItems) Contains(ref ItemRef) bool {
+	if k.keys[urlnorm.Key(ref.Link)] {
+		return true
+	}
+	guid := strings.TrimSpace(ref.GUID)
+	return guid != "" && k.guids[guid]
+}
+
+// ClearUnreliableGUIDs はアイテムの同一性の判定に使えないGUIDを空にする。フィード内の複数のアイテムで同じGUIDや、
+// フィード・サイトのURL (links) と同じGUIDを使うと、以降の新しいアイテムがすべて既存と判定されるため、
+// そのようなGUIDは存在確認にも保存にも使わない
+func ClearUnreliableGUIDs(items []*gofeed.Item, links ...string) {
+	counts := make(map[string]int)
+	for _, item := range items {
+		if guid := strings.TrimSpace(item.GUID); guid != "" {
+			counts[guid]++
+		}
+	}
+	linkKeys := make(map[string]bool)
+	for _, link := range links {
+		if strings.TrimSpace(link) != "" {
+			linkKeys[urlnorm.Key(link)] = true
+		}
+	}
+	for _, item := range items {
+		guid := strings.TrimSpace(item.GUID)
+		if guid != "" && (counts[guid] > 1 || linkKeys[urlnorm.Key(guid)]) {
+			item.GUID = ""
+		}
+	}
+}
+
+// ExistingItems はrefsのうちDBに既に存在するアイテムを1回のクエリでまとめて調べる。
+// GUIDはsiteURLのサイトのアイテムとのみ照合する
+func ExistingItems(db *gorm.DB, siteURL string, refs []ItemRef) (KnownItems, error) {
+	siteIDs := db.Session(&gorm.Session{NewDB: true}).Model(&Site{}).Select("id").Where("url = ?", siteURL)
+	return existingItems(db, siteIDs, refs)
+}
+
+// ItemExists は1件のアイテムが既に存在するかを返す。フィード単位で確認できる場合はExistingItemsを使う
+func ItemExists(db *gorm.DB, siteURL, link, guid string) (bool, error) {
+	ref := ItemRef{Link: link, GUID: guid}
+	known, err := ExistingItems(db, siteURL, []ItemRef{ref})
+	if err != nil {
+		return false, err
+	}
+	return known.Contains(ref), nil
+}
+
+// existingItems はsiteIDs (サイトIDの値またはサブクエリ) に対してrefsの存在を調べる
+func existingItems(db *gorm.DB, siteIDs interface{}, refs []ItemRef) (KnownItems, error) {
+	known := KnownItems{keys: make(map[string]bool), guids: make(map[string]bool)}
+	var keys, guids []string
+	for _, ref := range refs {
+		if ref.Link != "" {
+			keys = append(keys, urlnorm.Key(ref.Link))
+		}
+		if guid := strings.TrimSpace(ref.GUID); guid != "" {
+			guids = append(guids, guid)
+		}
+	}
+	if len(keys) == 0 && len(guids) == 0 {
+		return known, nil
+	}
+
+	// IN ()は構文エラーになるため、空の場合も1要素を渡す
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	if len(guids) == 0 {
+		guids = []string{""}
+	}
+	var rows []struct {
+		LinkKey *string
+		GUID    *string `gorm:"column:guid"`
+	}
+	err := db.Model(&Rss{}).
+		Select("link_key, CASE WHEN site_id IN (?) THEN guid END AS guid", siteIDs).
+		Where("link_key IN ? OR (guid IN ? AND site_id IN (?))", keys, guids, siteIDs).
+		Scan(&rows).Error
+	if err != nil {
+		return known, fmt.Errorf("failed to look up existing items: %w", err)
+	}
+	for _, row := range rows {
+		if row.LinkKey != nil {
+			known.keys[*row.LinkKey] = true
+		}
+		if row.GUID != nil && *row.GUID != "" {
+			known.guids[*row.GUID] = true
+		}
+	}
+	return known, nil
+}
+
+// dropKnownItems は既に存在するアイテムの行を除く。リンクが変わったアイテムも同じサイト内のGUIDで除外する
+func dropKnownItems(tx *gorm.DB, siteID uint, rows []Rss) ([]Rss, error) {
+	refs := make([]ItemRef, len(rows))
+	for i, row := range rows {
+		refs[i] = ItemRef{Link: row.Link, GUID: row.GUID}
+	}
+	known, err := existingItems(tx, []uint{siteID}, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []Rss
+	for i, row := range rows {
+		if known.Contains(refs[i]) {
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
@@ -0,0 +1,160 @@
+package dbmanager
+
+import (
+	"fmt"
+	"go-rss-sql/urlnorm"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB はBENCH_DATABASE_URLのDBに接続し、マイグレーションを適用する。未設定の場合はスキップする。
+// 投入したデータは終了時にロールバックするトランザクション内に置く。2つ目の戻り値は実行したクエリ数
+func testDB(b testing.TB) (*gorm.DB, *int) {
+	dsn := os.Getenv("BENCH_DATABASE_URL")
+	if dsn == "" {
+		b.Skip("BENCH_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := MigrateUp(db); err != nil {
+		b.Fatal(err)
+	}
+
+	queries := new(int)
+	count := func(*gorm.DB) { *queries++ }
+	if err := db.Callback().Query().After("gorm:query").Register("bench:count_query", count); err != nil {
+		b.Fatal(err)
+	}
+	if err := db.Callback().Row().After("gorm:row").Register("bench:count_row", count); err != nil {
+		b.Fatal(err)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		b.Fatal(tx.Error)
+	}
+	b.Cleanup(func() { tx.Rollback() })
+	return tx, queries
+}
+
+// seedLookupItems はサイトと既存アイテムを登録し、既存と新規が半数ずつのフィード1件分のrefsを返す
+func seedLookupItems(b testing.TB, tx *gorm.DB, siteURL string, existing, feedSize int) []ItemRef {
+	site := Site{Name: "bench", URL: siteURL}
+	if err := tx.Create(&site).Error; err != nil {
+		b.Fatal(err)
+	}
+	rows := make([]Rss, existing)
+	for i := range rows {
+		link := fmt.Sprintf("%s/items/%d", siteURL, i)
+		key := urlnorm.Key(link)
+		rows[i] = Rss{Title: link, Link: link, LinkKey: &key, SiteID: site.ID, GUID: fmt.Sprintf("guid-%d", i)}
+	}
+	if err := tx.CreateInBatches(rows, 500).Error; err != nil {
+		b.Fatal(err)
+	}
+
+	refs := make([]ItemRef, feedSize)
+	for i := range refs {
+		n := i
+		if i%2 == 1 {
+			n = existing + i
+		}
+		refs[i] = ItemRef{Link: fmt.Sprintf("%s/items/%d", siteURL, n), GUID: fmt.Sprintf("guid-%d", n)}
+	}
+	return refs
+}
+
+// BenchmarkExistingItems はフィード1件分の存在確認を、アイテムごとのItemExistsとまとめて調べるExistingItemsで比べる
+func BenchmarkExistingItems(b *testing.B) {
+	tx, queries := testDB(b)
+	const siteURL = "https://bench.example.com"
+	refs := seedLookupItems(b, tx, siteURL, 10000, 50)
+
+	b.Run("PerItem", func(b *testing.B) {
+		*queries = 0
+		for i := 0; i < b.N; i++ {
+			for _, ref := range refs {
+				if _, err := ItemExists(tx, siteURL, ref.Link, ref.GUID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(*queries)/float64(b.N), "queries/op")
+	})
+	b.Run("Batched", func(b *testing.B) {
+		*queries = 0
+		for i := 0; i < b.N; i++ {
+			known, err := ExistingItems(tx, siteURL, refs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, ref := range refs {
+				known.Contains(ref)
+			}
+		}
+		b.ReportMetric(float64(*queries)/float64(b.N), "queries/op")
+	})
+}
+
+func TestClearUnreliableGUIDs(t *testing.T) {
+	const siteURL = "https://example.com/"
+	const feedURL = "https://example.com/feed/"
+
+	tests := []struct {
+		name  string
+		guids []string
+		want  []string
+	}{
+		{"unique", []string{"a", "b", " c "}, []string{"a", "b", " c "}},
+		{"shared by every item", []string{"same", "same", "same"}, []string{"", "", ""}},
+		{"shared by some items", []string{"a", "dup", "dup", "b"}, []string{"a", "", "", "b"}},
+		{"site url", []string{"https://example.com", "https://example.com/posts/1"}, []string{"", "https://example.com/posts/1"}},
+		{"feed url", []string{"https://EXAMPLE.com/feed/#x"}, []string{""}},
+		{"empty", []string{"", "a"}, []string{"", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := make([]*gofeed.Item, len(tt.guids))
+			for i, guid := range tt.guids {
+				items[i] = &gofeed.Item{GUID: guid}
+			}
+			ClearUnreliableGUIDs(items, siteURL, feedURL)
+			got := make([]string, len(items))
+			for i, item := range items {
+				got[i] = item.GUID
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GUIDs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKnownItemsContains(t *testing.T) {
+	known := KnownItems{
+		keys:  map[string]bool{urlnorm.Key("https://example.com/posts/1"): true},
+		guids: map[string]bool{"guid-2": true},
+	}
+	tests := []struct {
+		ref  ItemRef
+		want bool
+	}{
+		{ItemRef{Link: "https://example.com/posts/1?utm_source=rss"}, true},
+		{ItemRef{Link: "https://example.com/posts/2", GUID: " guid-2 "}, true},
+		{ItemRef{Link: "https://example.com/posts/3", GUID: "guid-3"}, false},
+		{ItemRef{Link: "https://example.com/posts/4"}, false},
+	}
+	for _, tt := range tests {
+		if got := known.Contains(tt.ref); got != tt.want {
+			t.Errorf("Contains(%+v) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+}
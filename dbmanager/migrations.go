@@ -0,0 +1,445 @@
+package dbmanager
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration はスキーマ変更1件分。Versionの昇順に適用する
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration は適用済みのマイグレーションを記録するレコード
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationState はマイグレーションの適用状況
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// execSQL は与えられたSQLを順に実行するマイグレーション関数を返す
+func execSQL(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrations は既存のAutoMigrateで作られたテーブルにもそのまま適用できるよう、IF NOT EXISTSで記述する
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_sites_and_rsses",
+		Up: execSQL(
+			`CREATE TABLE IF NOT EXISTS sites (
+				id bigserial PRIMARY KEY,
+				created_at timestamptz,
+				updated_at timestamptz,
+				deleted_at timestamptz,
+				name text UNIQUE,
+				url text UNIQUE
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sites_deleted_at ON sites (deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS rsses (
+				id bigserial PRIMARY KEY,
+				created_at timestamptz,
+				updated_at timestamptz,
+				deleted_at timestamptz,
+				title text,
+				link text UNIQUE,
+				published_at timestamptz,
+				site_id bigint,
+				description text,
+				imgurl text,
+				tag text,
+				CONSTRAINT fk_sites_rss FOREIGN KEY (site_id) REFERENCES sites (id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_rsses_deleted_at ON rsses (deleted_at)`,
+		),
+		Down: execSQL(
+			`DROP TABLE IF EXISTS rsses`,
+			`DROP TABLE IF EXISTS sites`,
+		),
+	},
+	{
+		Version: 2,
+		Name:    "create_feeds",
+		Up: execSQL(
+			`CREATE TABLE IF NOT EXISTS feeds (
+				id bigserial PRIMARY KEY,
+				created_at timestamptz,
+				updated_at timestamptz,
+				deleted_at timestamptz,
+				url text NOT NULL UNIQUE,
+				site_link text,
+				enabled boolean NOT NULL,
+				notes text
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_feeds_deleted_at ON feeds (deleted_at)`,
+		),
+		Down: execSQL(`DROP TABLE IF EXISTS feeds`),
+	},
+	{
+		Version: 3,
+		Name:    "add_feed_conditional_get",
+		Up: execSQL(
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS etag text`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS last_modified text`,
+		),
+		Down: execSQL(
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS etag`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS last_modified`,
+		),
+	},
+	{
+		Version: 4,
+		Name:    "add_feed_health",
+		Up: execSQL(
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS consecutive_failures bigint NOT NULL DEFAULT 0`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS last_error text`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS last_status bigint`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS last_success_at timestamptz`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS next_attempt_at timestamptz`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS auto_disabled_at timestamptz`,
+		),
+		Down: execSQL(
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS consecutive_failures`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS last_error`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS last_status`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS last_success_at`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS next_attempt_at`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS auto_disabled_at`,
+		),
+	},
+	{
+		Version: 5,
+		Name:    "add_feed_schedule",
+		Up: execSQL(
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS poll_interval_seconds bigint`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS next_poll_at timestamptz`,
+			`CREATE INDEX IF NOT EXISTS idx_feeds_next_poll_at ON feeds (next_poll_at)`,
+		),
+		Down: execSQL(
+			`DROP INDEX IF EXISTS idx_feeds_next_poll_at`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS poll_interval_seconds`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS next_poll_at`,
+		),
+	},
+	{
+		Version: 6,
+		Name:    "create_tags",
+		Up: func(tx *gorm.DB) error {
+			err := execSQL(
+				`CREATE TABLE IF NOT EXISTS tags (
+					id bigserial PRIMARY KEY,
+					name text NOT NULL UNIQUE,
+					created_at timestamptz
+				)`,
+				`CREATE TABLE IF NOT EXISTS rss_tags (
+					rss_id bigint NOT NULL REFERENCES rsses (id) ON DELETE CASCADE,
+					tag_id bigint NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+					PRIMARY KEY (rss_id, tag_id)
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_rss_tags_tag_id ON rss_tags (tag_id)`,
+			)(tx)
+			if err != nil {
+				return err
+			}
+			return backfillTags(tx)
+		},
+		Down: execSQL(
+			`DROP TABLE IF EXISTS rss_tags`,
+			`DROP TABLE IF EXISTS tags`,
+		),
+	},
+	{
+		Version: 7,
+		Name:    "add_rss_published_at_inferred",
+		Up:      execSQL(`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS published_at_inferred boolean NOT NULL DEFAULT false`),
+		Down:    execSQL(`ALTER TABLE rsses DROP COLUMN IF EXISTS published_at_inferred`),
+	},
+	{
+		Version: 8,
+		Name:    "add_rss_metadata",
+		Up: execSQL(
+			`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS guid text`,
+			`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS author text`,
+			`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS item_updated_at timestamptz`,
+			`CREATE INDEX IF NOT EXISTS idx_rsses_site_id_guid ON rsses (site_id, guid)`,
+			`CREATE TABLE IF NOT EXISTS rss_contents (
+				rss_id bigint PRIMARY KEY REFERENCES rsses (id) ON DELETE CASCADE,
+				content text
+			)`,
+			`CREATE TABLE IF NOT EXISTS rss_enclosures (
+				id bigserial PRIMARY KEY,
+				rss_id bigint NOT NULL REFERENCES rsses (id) ON DELETE CASCADE,
+				url text,
+				type text,
+				length bigint,
+				UNIQUE (rss_id, url)
+			)`,
+		),
+		Down: execSQL(
+			`DROP TABLE IF EXISTS rss_enclosures`,
+			`DROP TABLE IF EXISTS rss_contents`,
+			`DROP INDEX IF EXISTS idx_rsses_site_id_guid`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS item_updated_at`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS author`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS guid`,
+		),
+	},
+	{
+		Version: 9,
+		Name:    "add_rss_link_key",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec(`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS link_key text`).Error; err != nil {
+				return err
+			}
+			// 既存のアイテムにキーを設定し、正規化すると同じリンクになる重複を統合してから一意制約を付ける
+			if _, err := RebuildLinkKeys(tx, false); err != nil {
+				return err
+			}
+			return tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_rsses_link_key ON rsses (link_key)`).Error
+		},
+		Down: execSQL(
+			`DROP INDEX IF EXISTS idx_rsses_link_key`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS link_key`,
+		),
+	},
+	{
+		Version: 10,
+		Name:    "create_clusters",
+		Up: execSQL(
+			`CREATE TABLE IF NOT EXISTS clusters (
+				id bigserial PRIMARY KEY,
+				representative_id bigint NOT NULL REFERENCES rsses (id) ON DELETE CASCADE,
+				created_at timestamptz,
+				updated_at timestamptz
+			)`,
+			`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS title_hash bigint`,
+			`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS image_hash bigint`,
+			`ALTER TABLE rsses ADD COLUMN IF NOT EXISTS cluster_id bigint REFERENCES clusters (id) ON DELETE SET NULL`,
+			`CREATE INDEX IF NOT EXISTS idx_rsses_cluster_id ON rsses (cluster_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_rsses_published_at ON rsses (published_at)`,
+		),
+		Down: execSQL(
+			`DROP INDEX IF EXISTS idx_rsses_published_at`,
+			`DROP INDEX IF EXISTS idx_rsses_cluster_id`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS cluster_id`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS image_hash`,
+			`ALTER TABLE rsses DROP COLUMN IF EXISTS title_hash`,
+			`DROP TABLE IF EXISTS clusters`,
+		),
+	},
+	{
+		Version: 11,
+		Name:    "add_feed_kind_and_comments",
+		Up: execSQL(
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS kind text NOT NULL DEFAULT 'article'`,
+			`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS comment_policy text NOT NULL DEFAULT ''`,
+			`UPDATE feeds SET kind = 'comment' WHERE lower(url) LIKE '%/comments/feed%'
+				OR lower(url) LIKE '%feed=comments-rss2%' OR lower(url) LIKE '%feed=comments-atom%'
+				OR lower(url) LIKE '%/feeds/comments/%'`,
+			`CREATE TABLE IF NOT EXISTS comments (
+				id bigserial PRIMARY KEY,
+				created_at timestamptz,
+				site_id bigint REFERENCES sites (id) ON DELETE SET NULL,
+				rss_id bigint REFERENCES rsses (id) ON DELETE SET NULL,
+				link text UNIQUE,
+				parent_link text,
+				author text,
+				title text,
+				content text,
+				published_at timestamptz
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_comments_rss_id ON comments (rss_id)`,
+		),
+		Down: execSQL(
+			`DROP TABLE IF EXISTS comments`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS comment_policy`,
+			`ALTER TABLE feeds DROP COLUMN IF EXISTS kind`,
+		),
+	},
+	{
+		Version: 12,
+		Name:    "add_feed_group",
+		Up:      execSQL(`ALTER TABLE feeds ADD COLUMN IF NOT EXISTS feed_group text NOT NULL DEFAULT ''`),
+		Down:    execSQL(`ALTER TABLE feeds DROP COLUMN IF EXISTS feed_group`),
+	},
+	{
+		Version: 13,
+		Name:    "create_page_images",
+		Up: execSQL(`CREATE TABLE IF NOT EXISTS page_images (
+			url text PRIMARY KEY,
+			image_url text NOT NULL DEFAULT '',
+			source text NOT NULL DEFAULT '',
+			error text NOT NULL DEFAULT '',
+			fetched_at timestamptz
+		)`),
+		Down: execSQL(`DROP TABLE IF EXISTS page_images`),
+	},
+	{
+		// サイト名はフィードのタイトルのため重複を許す。AutoMigrateで作られたテーブルの一意インデックスも外す
+		Version: 14,
+		Name:    "drop_sites_name_unique",
+		Up: execSQL(
+			`ALTER TABLE sites DROP CONSTRAINT IF EXISTS sites_name_key`,
+			`DROP INDEX IF EXISTS idx_sites_name`,
+			`CREATE INDEX IF NOT EXISTS idx_sites_name ON sites (name)`,
+		),
+		Down: execSQL(
+			`DROP INDEX IF EXISTS idx_sites_name`,
+			`ALTER TABLE sites ADD CONSTRAINT sites_name_key UNIQUE (name)`,
+		),
+	},
+}
+
+func ensureMigrationTable(db *gorm.DB) error {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func appliedVersions(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := ensureMigrationTable(db); err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load schema_migrations: %w", err)
+	}
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func sortedMigrations() []Migration {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// migrationLockID はマイグレーション中に取得するアドバイザリロックのキー
+const migrationLockID int64 = 0x7273735f6d6967 // "rss_mig"
+
+// withMigrationLock はアドバイザリロックを取得した1つの接続でfnを実行する。
+// シャードごとのプロセスが同時に起動しても、マイグレーションを適用するのは1プロセスのみになる
+func withMigrationLock(db *gorm.DB, fn func(conn *gorm.DB) error) error {
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockID).Error; err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockID)
+		return fn(conn)
+	})
+}
+
+// MigrateUp は未適用のマイグレーションをすべて適用し、適用したものを返す。
+// 適用済みのバージョンはロックを取得してから読み込むため、他のプロセスが適用したものは適用し直さない
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range sortedMigrations() {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown は適用済みのマイグレーションを新しいものからsteps件取り消し、取り消したものを返す
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		sorted := sortedMigrations()
+		for i := len(sorted) - 1; i >= 0 && len(done) < steps; i-- {
+			m := sorted[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("rollback of migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrationStatus はすべてのマイグレーションと適用日時を返す
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	var applied map[int]SchemaMigration
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		var err error
+		applied, err = appliedVersions(conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, m := range sortedMigrations() {
+		state := MigrationState{Migration: m}
+		if row, ok := applied[m.Version]; ok {
+			appliedAt := row.AppliedAt
+			state.AppliedAt = &appliedAt
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
@@ -0,0 +1,51 @@
+package dbmanager
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PageImage は記事ページから見つけた代表画像のキャッシュ。再実行時に同じページを取得し直さないために使う。
+// 画像が見つからなかった場合はImageURLを空で、取得に失敗した場合はErrorを記録する
+type PageImage struct {
+	URL       string `gorm:"primaryKey"`
+	ImageURL  string `gorm:"not null;default:''"`
+	Source    string `gorm:"not null;default:''"`
+	Error     string `gorm:"not null;default:''"`
+	FetchedAt time.Time
+}
+
+func (PageImage) TableName() string {
+	return "page_images"
+}
+
+// CachedPageImage は記事ページのキャッシュを返す。取得に失敗した記録はretryより古ければ未取得として扱う
+func CachedPageImage(db *gorm.DB, pageURL string, retry time.Duration) (*PageImage, error) {
+	var cached PageImage
+	result := db.Where("url = ?", pageURL).Limit(1).Find(&cached)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to load page image: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	if cached.Error != "" && time.Since(cached.FetchedAt) > retry {
+		return nil, nil
+	}
+	return &cached, nil
+}
+
+// SavePageImage は記事ページの取得結果を保存する。既に記録があれば上書きする
+func SavePageImage(db *gorm.DB, page PageImage) error {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "url"}},
+		DoUpdates: clause.AssignmentColumns([]string{"image_url", "source", "error", "fetched_at"}),
+	}).Create(&page).Error
+	if err != nil {
+		return fmt.Errorf("failed to save page image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package dbmanager
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Tag は正規化済みのタグ名
+type Tag struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"unique;not null"`
+	CreatedAt time.Time
+}
+
+func (Tag) TableName() string {
+	return "tags"
+}
+
+// RssTag はアイテムとタグの対応
+type RssTag struct {
+	RssID uint `gorm:"primaryKey"`
+	TagID uint `gorm:"primaryKey"`
+}
+
+func (RssTag) TableName() string {
+	return "rss_tags"
+}
+
+// TagCount はタグと、そのタグが付いたアイテム数
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+var tagFolder = cases.Fold()
+
+// NormalizeTag はタグ名を正規化する。NFKCで全角英数字・半角カナの幅を揃え、
+// 大文字小文字を区別しない形にしたうえで、前後の空白を除き連続する空白を1つにまとめる
+func NormalizeTag(name string) string {
+	name = norm.NFKC.String(name)
+	name = tagFolder.String(name)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// NormalizeTags はカテゴリ一覧を正規化し、空や重複を除いて返す。
+// "1,000円以下"のようにカンマを含むカテゴリ名もあるため、各カテゴリは分割しない
+func NormalizeTags(categories []string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, category := range categories {
+		tag := NormalizeTag(category)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// attachTags はアイテムごとのタグをrss_tagsへ保存する。idsとtagsByLinkは同じキー (リンクなど) で対応づける。既に付いているタグは無視する
+func attachTags(tx *gorm.DB, ids map[string]uint, tagsByLink map[string][]string) error {
+	var names []string
+	nameSeen := make(map[string]bool)
+	for _, tags := range tagsByLink {
+		for _, tag := range tags {
+			if !nameSeen[tag] {
+				nameSeen[tag] = true
+				names = append(names, tag)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	tagIDs, err := ensureTags(tx, names)
+	if err != nil {
+		return err
+	}
+
+	var rssTags []RssTag
+	for link, tags := range tagsByLink {
+		id, ok := ids[link]
+		if !ok {
+			continue
+		}
+		for _, tag := range tags {
+			rssTags = append(rssTags, RssTag{RssID: id, TagID: tagIDs[tag]})
+		}
+	}
+	if len(rssTags) == 0 {
+		return nil
+	}
+	err = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(rssTags, 1000).Error
+	if err != nil {
+		return fmt.Errorf("failed to insert rss tags: %w", err)
+	}
+	return nil
+}
+
+// ensureTags は正規化済みのタグ名を登録し、タグ名とIDの対応を返す
+func ensureTags(tx *gorm.DB, names []string) (map[string]uint, error) {
+	tags := make([]Tag, len(names))
+	for i, name := range names {
+		tags[i] = Tag{Name: name}
+	}
+	err := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "name"}}, DoNothing: true}).
+		CreateInBatches(&tags, 1000).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert tags: %w", err)
+	}
+
+	var found []Tag
+	if err := tx.Where("name IN ?", names).Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	ids := make(map[string]uint, len(found))
+	for _, tag := range found {
+		ids[tag.Name] = tag.ID
+	}
+	return ids, nil
+}
+
+// GetTagCounts はタグをアイテム数の多い順に返す
+func GetTagCounts(db *gorm.DB, limit int) ([]TagCount, error) {
+	var counts []TagCount
+	err := db.Table("rss_tags").
+		Select("tags.name AS name, COUNT(*) AS count").
+		Joins("JOIN tags ON tags.id = rss_tags.tag_id").
+		Group("tags.name").Order("count desc, tags.name").Limit(limit).
+		Scan(&counts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tags: %w", err)
+	}
+	return counts, nil
+}
+
+// WhereTag はクエリを指定したタグが付いたアイテムに絞り込む
+func WhereTag(query *gorm.DB, name string) *gorm.DB {
+	return query.Where("rsses.id IN (?)",
+		query.Session(&gorm.Session{NewDB: true}).Table("rss_tags").Select("rss_tags.rss_id").
+			Joins("JOIN tags ON tags.id = rss_tags.tag_id").
+			Where("tags.name = ?", NormalizeTag(name)))
+}
+
+// backfillTags は既存のrsses.tagからタグを作成する。rsses.tagはカテゴリをカンマ区切りで連結したものなので分割する
+func backfillTags(tx *gorm.DB) error {
+	var batch []Rss
+	return tx.Select("id", "link", "tag").Where("tag <> ''").
+		FindInBatches(&batch, 1000, func(batchTx *gorm.DB, _ int) error {
+			ids := make(map[string]uint, len(batch))
+			tagsByLink := make(map[string][]string, len(batch))
+			for _, item := range batch {
+				if tags := NormalizeTags(strings.Split(item.Tag, ",")); len(tags) > 0 {
+					ids[item.Link] = item.ID
+					tagsByLink[item.Link] = tags
+				}
+			}
+			return attachTags(tx, ids, tagsByLink)
+		}).Error
+}
@@ -0,0 +1,43 @@
+package dbmanager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Golang", "golang"},
+		{"  Go   言語  ", "go 言語"},
+		{"ＡＢＣ１２３", "abc123"},
+		{"ｶﾀｶﾅ", "カタカナ"},
+		{"Straße", "strasse"},
+		{"1,000円以下", "1,000円以下"},
+		{"\t\n", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeTag(tt.name); got != tt.want {
+			t.Errorf("NormalizeTag(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		categories []string
+		want       []string
+	}{
+		{nil, nil},
+		{[]string{"Go", "go", "ＧＯ"}, []string{"go"}},
+		{[]string{"", " ", "News"}, []string{"news"}},
+		{[]string{"1,000円以下", "セール"}, []string{"1,000円以下", "セール"}},
+	}
+	for _, tt := range tests {
+		if got := NormalizeTags(tt.categories); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NormalizeTags(%q) = %q, want %q", tt.categories, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package discovery
+
+import (
+	"fmt"
+	"go-rss-sql/dbmanager"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+)
+
+// maxPageBytes はトップページから<link rel="alternate">を探すために読み込む上限
+const maxPageBytes = 1024 * 1024
+
+// feedTypes は<link rel="alternate">のうちフィードとして扱うtype
+var feedTypes = map[string]bool{
+	"application/rss+xml":  true,
+	"application/atom+xml": true,
+	"application/rdf+xml":  true,
+	"application/xml":      true,
+	"text/xml":             true,
+}
+
+// commonPaths はブログサービスでよく使われるフィードのパス。<link rel="alternate">で見つからない場合に順に試す
+var commonPaths = []string{
+	"/feed/",           // WordPress, blogterest
+	"/?feed=rss2",      // パーマリンク未設定のWordPress
+	"/?xml",            // FC2ブログ
+	"/rsslatest.xml",   // FC2ブログ (新着)
+	"/index.rdf",       // livedoorブログ, Movable Type
+	"/atom.xml",        // Blogger, livedoorブログ
+	"/index.php/feed/", // index.phpを含むWordPress
+	"/rss/",
+}
+
+// 候補の見つけ方
+const (
+	SourceLink  = "link"  // <link rel="alternate">
+	SourceGuess = "guess" // よく使われるパス
+)
+
+// Candidate はフィードURLの候補と、gofeedで取得・解析した結果
+type Candidate struct {
+	URL    string
+	Source string
+	Title  string
+	Kind   string // dbmanager.FeedKindArticle / dbmanager.FeedKindComment
+	Items  int
+	Err    error
+}
+
+// Valid はフィードとして解析できたかを返す
+func (c Candidate) Valid() bool {
+	return c.Err == nil
+}
+
+// Discoverer はサイトのトップページからフィードを探す
+type Discoverer struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+func NewDiscoverer(timeout time.Duration) *Discoverer {
+	return &Discoverer{Client: &http.Client{Timeout: timeout}, UserAgent: "Gofeed/1.0"}
+}
+
+// Discover はhomepageの<link rel="alternate">と、よく使われるパスからフィードを探して検証し、候補を良い順に返す。
+// パスの推測は記事のフィードが見つかった時点でやめる
+func (d *Discoverer) Discover(homepage string) ([]Candidate, error) {
+	base, err := parseHomepage(homepage)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Candidate
+	seen := make(map[string]bool)
+	try := func(feedURL, source string) {
+		if seen[feedURL] {
+			return
+		}
+		seen[feedURL] = true
+		candidates = append(candidates, d.validate(feedURL, source))
+	}
+
+	// トップページが取得できなくても、パスの推測は試す
+	links, pageErr := d.alternateLinks(base.String())
+	for _, link := range links {
+		try(link, SourceLink)
+	}
+	for _, guess := range guessPaths(base) {
+		if hasArticleFeed(candidates) {
+			break
+		}
+		ref, err := url.Parse(guess)
+		if err != nil {
+			continue
+		}
+		try(base.ResolveReference(ref).String(), SourceGuess)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return rank(candidates[i]) > rank(candidates[j]) })
+	if !hasArticleFeed(candidates) && pageErr != nil {
+		return candidates, fmt.Errorf("トップページの取得に失敗しました: %w", pageErr)
+	}
+	return candidates, nil
+}
+
+// parseHomepage はトップページのURLを解析する。"example.com"のようにスキームがなければhttpsとして扱う
+func parseHomepage(homepage string) (*url.URL, error) {
+	raw := strings.TrimSpace(homepage)
+	if strings.HasPrefix(raw, "//") {
+		raw = "https:" + raw
+	} else if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	base, err := url.Parse(raw)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("URLを解析できません: %q", homepage)
+	}
+	return base, nil
+}
+
+// Best は候補のうち登録すべき記事のフィードを返す
+func Best(candidates []Candidate) (Candidate, bool) {
+	for _, c := range candidates {
+		if c.Valid() && c.Kind == dbmanager.FeedKindArticle {
+			return c, true
+		}
+	}
+	return Candidate{}, false
+}
+
+// alternateLinks はトップページの<link rel="alternate">からフィードのURLを文書順に返す
+func (d *Discoverer) alternateLinks(pageURL string) ([]string, error) {
+	resp, err := d.get(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return AlternateLinks(io.LimitReader(resp.Body, maxPageBytes), resp.Request.URL)
+}
+
+// AlternateLinks はHTMLの<link rel="alternate">のうちフィードを指すものを、baseを基準に絶対URLにして返す
+func AlternateLinks(r io.Reader, base *url.URL) ([]string, error) {
+	var links []string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return links, nil
+			}
+			return links, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if token.Data == "body" {
+				return links, nil
+			}
+			if token.Data != "link" {
+				continue
+			}
+			var rel, typ, href string
+			for _, a := range token.Attr {
+				switch strings.ToLower(a.Key) {
+				case "rel":
+					rel = strings.ToLower(a.Val)
+				case "type":
+					typ = strings.ToLower(strings.TrimSpace(a.Val))
+				case "href":
+					href = strings.TrimSpace(a.Val)
+				}
+			}
+			if href == "" || !strings.Contains(" "+rel+" ", " alternate ") || !feedTypes[typ] {
+				continue
+			}
+			ref, err := url.Parse(href)
+			if err != nil {
+				continue
+			}
+			links = append(links, base.ResolveReference(ref).String())
+		}
+	}
+}
+
+// guessPaths は試すパスを返す。FC2ブログは?xmlを先に試す
+func guessPaths(base *url.URL) []string {
+	host := strings.ToLower(base.Hostname())
+	paths := commonPaths
+	if strings.HasSuffix(host, ".fc2.com") {
+		paths = append([]string{"/?xml"}, commonPaths...)
+	}
+	// サブディレクトリに設置されたブログはそのディレクトリを基準にする。/blog/index.htmlのように
+	// ファイルを指すURLはそのファイルのディレクトリを使う
+	dir := base.Path
+	if last := path.Base(dir); strings.Contains(last, ".") && !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" || dir == "." {
+		return paths
+	}
+	prefixed := make([]string, len(paths))
+	for i, p := range paths {
+		prefixed[i] = dir + p
+	}
+	return prefixed
+}
+
+// validate はフィードを取得・解析し、記事とコメントのどちらのフィードかを判定する
+func (d *Discoverer) validate(feedURL, source string) Candidate {
+	c := Candidate{URL: feedURL, Source: source, Kind: dbmanager.FeedKindOf(feedURL)}
+	resp, err := d.get(feedURL)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	defer resp.Body.Close()
+
+	feed, err := gofeed.NewParser().Parse(resp.Body)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	c.Title = feed.Title
+	c.Items = len(feed.Items)
+	comments := 0
+	for _, item := range feed.Items {
+		if dbmanager.IsCommentItem(item) {
+			comments++
+		}
+	}
+	if c.Items > 0 && comments == c.Items {
+		c.Kind = dbmanager.FeedKindComment
+	}
+	return c
+}
+
+func (d *Discoverer) get(target string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", d.UserAgent)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+func hasArticleFeed(candidates []Candidate) bool {
+	_, ok := Best(candidates)
+	return ok
+}
+
+// rank は候補の優先度を返す。解析できた記事のフィードを優先し、<link rel="alternate">で見つかったもの、アイテムの多いものを上位にする
+func rank(c Candidate) int {
+	score := 0
+	if c.Valid() {
+		score += 1000
+	}
+	if c.Kind == dbmanager.FeedKindArticle {
+		score += 500
+	}
+	if c.Source == SourceLink {
+		score += 100
+	}
+	if c.Items > 99 {
+		return score + 99
+	}
+	return score + c.Items
+}
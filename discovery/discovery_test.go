@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlternateLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/")
+	tests := []struct {
+		name string
+		html string
+		want []string
+	}{
+		{
+			name: "rss and atom",
+			html: `<html><head>
+				<link rel="alternate" type="application/rss+xml" href="/feed/">
+				<link rel="alternate" type="application/atom+xml" href="atom.xml">
+			</head></html>`,
+			want: []string{"https://example.com/feed/", "https://example.com/blog/atom.xml"},
+		},
+		{
+			name: "case and extra rel values",
+			html: `<link REL="Alternate nofollow" TYPE=" Application/RSS+XML " HREF="https://feeds.example.net/a">`,
+			want: []string{"https://feeds.example.net/a"},
+		},
+		{
+			name: "not a feed",
+			html: `<link rel="alternate" type="text/html" hreflang="en" href="/en/">
+				<link rel="stylesheet" type="text/css" href="/style.css">
+				<link rel="alternate" type="application/rss+xml" href="">`,
+			want: nil,
+		},
+		{
+			name: "stops at body",
+			html: `<head></head><body><link rel="alternate" type="application/rss+xml" href="/feed/"></body>`,
+			want: nil,
+		},
+		{
+			name: "protocol-relative",
+			html: `<link rel="alternate" type="application/rdf+xml" href="//example.com/index.rdf" />`,
+			want: []string{"https://example.com/index.rdf"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AlternateLinks(strings.NewReader(tt.html), base)
+			if err != nil {
+				t.Fatalf("AlternateLinks() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AlternateLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHomepage(t *testing.T) {
+	tests := []struct {
+		homepage string
+		want     string
+		wantErr  bool
+	}{
+		{"https://example.com/", "https://example.com/", false},
+		{"http://example.com/blog/", "http://example.com/blog/", false},
+		{"example.com", "https://example.com", false},
+		{"  example.com/blog/  ", "https://example.com/blog/", false},
+		{"//example.com/", "https://example.com/", false},
+		{"example.com:8080/blog", "https://example.com:8080/blog", false},
+		{"", "", true},
+		{"https://", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseHomepage(tt.homepage)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseHomepage(%q) = %v, want error", tt.homepage, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("parseHomepage(%q) = %v, %v, want %q", tt.homepage, got, err, tt.want)
+		}
+	}
+}
+
+func TestGuessPaths(t *testing.T) {
+	tests := []struct {
+		homepage string
+		first    string
+	}{
+		{"https://example.com/", "/feed/"},
+		{"https://example.com", "/feed/"},
+		{"https://example.com/blog/", "/blog/feed/"},
+		{"https://example.com/blog", "/blog/feed/"},
+		{"https://example.com/blog/index.html", "/blog/feed/"},
+		{"https://example.com/index.php", "/feed/"},
+		{"https://example.com/v1.2/", "/v1.2/feed/"},
+		{"https://someone.blog.fc2.com/", "/?xml"},
+	}
+	for _, tt := range tests {
+		base, err := parseHomepage(tt.homepage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := guessPaths(base)
+		if len(paths) == 0 || paths[0] != tt.first {
+			t.Errorf("guessPaths(%q) = %q, want it to start with %q", tt.homepage, paths, tt.first)
+		}
+		for _, p := range paths {
+			if strings.Contains(p, ".html/") || strings.HasPrefix(p, "/index.php/index.php/") {
+				t.Errorf("guessPaths(%q) contains %q under a file name", tt.homepage, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package extractor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+
+	webp "github.com/chai2010/webp"
+)
+
+// GIF画像の扱い
+const (
+	GIFAnimate = "animate" // アニメーションWebPへ変換する
+	GIFStill   = "still"   // 最初のフレームを静止画のWebPへ変換する
+	GIFReject  = "reject"  // 変換しない
+)
+
+// GIFPolicy はGIF画像の変換方法と上限
+type GIFPolicy struct {
+	Mode string
+	// フレーム数がこれを超えるアニメーションは最初のフレームのみを使う
+	MaxFrames int
+	// ファイルサイズ (バイト) がこれを超えるGIFは変換しない
+	MaxBytes int64
+	// アニメーションでデコード・合成するフレームの画素数の合計 (フレーム数×幅×高さ) の上限。
+	// 超えるアニメーションやキャンバス1枚でも超えるGIFは、デコードする前に変換しないと判定する
+	MaxPixels int64
+}
+
+// Image は取得・デコードした画像。GIFアニメーションをアニメーションWebPへ変換する場合はFramesとDelaysを持つ
+type Image struct {
+	// 静止画、またはアニメーションの最初のフレーム。寸法の確認と知覚ハッシュに使う
+	Still image.Image
+	// キャンバス全体に合成済みの各フレームと表示時間 (ミリ秒)。静止画の場合は空
+	Frames    []*image.RGBA
+	Delays    []int
+	LoopCount int
+}
+
+// Animated はアニメーションWebPへ変換するかを返す
+func (img *Image) Animated() bool {
+	return len(img.Frames) > 1
+}
+
+// WebP は画像をWebPへ変換する。アニメーションの場合はアニメーションWebPにする
+func (img *Image) WebP() ([]byte, error) {
+	if img.Animated() {
+		return EncodeAnimatedWebP(img.Frames, img.Delays, img.LoopCount)
+	}
+	return EncodeWebP(img.Still)
+}
+
+// decodeGIF はGIFをデコードする。アニメーションWebPへ変換する場合のみすべてのフレームをデコードし、
+// 静止画として扱う場合は最初のフレームのみをデコードする。フレームの寸法はデコードする前にブロックを読んで確認する
+func decodeGIF(data []byte, policy GIFPolicy) (*Image, error) {
+	if policy.Mode == GIFReject {
+		return nil, errors.New("GIF画像はサポートされていません")
+	}
+	if policy.MaxBytes > 0 && int64(len(data)) > policy.MaxBytes {
+		return nil, fmt.Errorf("GIF画像が大きすぎます: %dバイト", len(data))
+	}
+	layout, err := scanGIF(data)
+	if err != nil {
+		return nil, fmt.Errorf("画像のデコード時のエラー: %w", err)
+	}
+	if layout.Frames == 0 {
+		return nil, errors.New("GIF画像にフレームがありません")
+	}
+	canvas := int64(layout.Bounds.Dx()) * int64(layout.Bounds.Dy())
+	if policy.MaxPixels > 0 && canvas > policy.MaxPixels {
+		return nil, fmt.Errorf("GIF画像の寸法が大きすぎます: %dx%d", layout.Bounds.Dx(), layout.Bounds.Dy())
+	}
+
+	animate := policy.Mode == GIFAnimate && layout.Frames > 1
+	if animate && policy.MaxFrames > 0 && layout.Frames > policy.MaxFrames {
+		animate = false
+	}
+	if animate && policy.MaxPixels > 0 &&
+		(layout.FramePixels > policy.MaxPixels || int64(layout.Frames)*canvas > policy.MaxPixels) {
+		return nil, fmt.Errorf("GIFアニメーションの画素数が上限を超えています: %dフレーム, %dx%d",
+			layout.Frames, layout.Bounds.Dx(), layout.Bounds.Dy())
+	}
+
+	if !animate {
+		first, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("画像のデコード時のエラー: %w", err)
+		}
+		paletted, ok := first.(*image.Paletted)
+		if !ok {
+			return nil, errors.New("GIF画像のフレームが不正です")
+		}
+		g := &gif.GIF{Image: []*image.Paletted{paletted}, Config: image.Config{Width: layout.Bounds.Dx(), Height: layout.Bounds.Dy()}}
+		return &Image{Still: compositeGIF(g)[0]}, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("画像のデコード時のエラー: %w", err)
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("GIF画像にフレームがありません")
+	}
+	frames := compositeGIF(g)
+	img := &Image{Still: frames[0], Frames: frames, LoopCount: webpLoopCount(g.LoopCount)}
+	for _, delay := range g.Delay {
+		img.Delays = append(img.Delays, gifDelay(delay))
+	}
+	return img, nil
+}
+
+// gifLayout はデコードせずにブロックを読んで得たGIFのキャンバスとフレームの情報
+type gifLayout struct {
+	// キャンバスの範囲。ヘッダに寸法がない場合は全フレームを含む範囲
+	Bounds image.Rectangle
+	Frames int
+	// 各フレームの画素数の合計。すべてのフレームをデコードする際のメモリの目安
+	FramePixels int64
+}
+
+// scanGIF はGIFのブロックを順に読み、イメージディスクリプタの数と寸法を集計する。
+// LZWのデータは展開せずに読み飛ばす。トレーラがなく途中で終わっている場合はそこまでを集計する
+func scanGIF(data []byte) (gifLayout, error) {
+	var layout gifLayout
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return layout, errors.New("GIFのヘッダが不正です")
+	}
+	width, height := int(binary.LittleEndian.Uint16(data[6:])), int(binary.LittleEndian.Uint16(data[8:]))
+	layout.Bounds = image.Rect(0, 0, width, height)
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	// skipSubBlocks はサイズ付きのサブブロックを終端 (サイズ0) まで読み飛ばす
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var union image.Rectangle
+scan:
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // 拡張ブロック
+			pos += 2
+			if !skipSubBlocks() {
+				break scan
+			}
+		case 0x2C: // イメージディスクリプタ
+			if pos+10 > len(data) {
+				break scan
+			}
+			d := data[pos+1 : pos+10]
+			left, top := int(binary.LittleEndian.Uint16(d[0:])), int(binary.LittleEndian.Uint16(d[2:]))
+			w, h := int(binary.LittleEndian.Uint16(d[4:])), int(binary.LittleEndian.Uint16(d[6:]))
+			layout.Frames++
+			layout.FramePixels += int64(w) * int64(h)
+			union = union.Union(image.Rect(left, top, left+w, top+h))
+			pos += 10
+			if flags := d[8]; flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos++ // LZWの最小コードサイズ
+			if !skipSubBlocks() {
+				break scan
+			}
+		case 0x3B: // トレーラ
+			break scan
+		default:
+			return layout, fmt.Errorf("GIFのブロックが不正です: 0x%02x", data[pos])
+		}
+	}
+	if layout.Bounds.Empty() {
+		layout.Bounds = union
+	}
+	return layout, nil
+}
+
+// compositeGIF は各フレームを廃棄方法に従って重ね、キャンバス全体の画像にして返す
+func compositeGIF(g *gif.GIF) []*image.RGBA {
+	canvas := image.NewRGBA(gifBounds(g))
+	frames := make([]*image.RGBA, 0, len(g.Image))
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneRGBA(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// gifBounds はキャンバスの範囲を返す。ヘッダに寸法がない場合は全フレームを含む範囲にする
+func gifBounds(g *gif.GIF) image.Rectangle {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+	return bounds
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Rect)
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// gifDelay はGIFの表示時間 (1/100秒) をミリ秒にする。0や1はブラウザと同じく100ミリ秒として扱う
+func gifDelay(delay int) int {
+	if delay < 2 {
+		return 100
+	}
+	return delay * 10
+}
+
+// webpLoopCount はGIFのループ回数 (0は無限、-1は1回のみ、nは追加でn回) をWebPのループ回数 (0は無限) にする
+func webpLoopCount(loop int) int {
+	switch {
+	case loop == 0:
+		return 0
+	case loop < 0:
+		return 1
+	case loop >= 0xffff:
+		return 0xffff
+	default:
+		return loop + 1
+	}
+}
+
+// EncodeAnimatedWebP はキャンバス全体のフレームを1枚ずつWebPへ変換し、アニメーションWebPのRIFFにまとめる。
+// 各フレームはキャンバスと同じ大きさのため、重ね合わせずに置き換えて表示させる
+func EncodeAnimatedWebP(frames []*image.RGBA, delays []int, loopCount int) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("フレームがありません")
+	}
+	bounds := frames[0].Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+
+	// VP8X: アニメーションとアルファのフラグ、キャンバスの寸法
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 | 0x10
+	putUint24(vp8x[4:], width-1)
+	putUint24(vp8x[7:], height-1)
+	writeChunk(&body, "VP8X", vp8x)
+
+	// ANIM: 背景色 (透明) とループ回数
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:], uint16(loopCount))
+	writeChunk(&body, "ANIM", anim)
+
+	quality := float32(85)
+	for i, frame := range frames {
+		data, err := webp.EncodeRGBA(frame, quality)
+		if err != nil {
+			return nil, fmt.Errorf("WebPへの変換エラー: %w", err)
+		}
+		bitstream, err := frameBitstream(data)
+		if err != nil {
+			return nil, err
+		}
+		delay := 100
+		if i < len(delays) {
+			delay = delays[i]
+		}
+
+		header := make([]byte, 16)
+		putUint24(header[6:], frame.Bounds().Dx()-1)
+		putUint24(header[9:], frame.Bounds().Dy()-1)
+		putUint24(header[12:], delay)
+		header[15] = 0x02 // 重ね合わせない, 表示後に廃棄しない
+		writeChunk(&body, "ANMF", append(header, bitstream...))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+// frameBitstream は静止画のWebPからRIFFヘッダとVP8Xを除き、ANMFに入れるALPH・VP8・VP8Lのチャンクを返す
+func frameBitstream(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("WebPのヘッダが不正です")
+	}
+	var out []byte
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + size + size%2
+		if pos+8+size > len(data) {
+			return nil, errors.New("WebPのチャンクが不正です")
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		switch fourCC {
+		case "ALPH", "VP8 ", "VP8L":
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	if len(out) == 0 {
+		return nil, errors.New("WebPに画像データがありません")
+	}
+	return out, nil
+}
+
+func writeChunk(buf *bytes.Buffer, fourCC string, payload []byte) {
+	buf.WriteString(fourCC)
+	binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
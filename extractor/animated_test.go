@@ -0,0 +1,196 @@
+package extractor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"runtime"
+	"testing"
+)
+
+// testGIF は寸法w×hのフレームをn枚持つGIFを作る
+func testGIF(t *testing.T, n, w, h int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{LoopCount: 0}
+	for i := 0; i < n; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+		frame.SetColorIndex(i%w, 0, 1)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 5)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hugeGIF はw×hの空のフレームをn枚持つGIFを、1枚分のエンコード結果を繰り返して作る。
+// ファイルは小さいが、すべてのフレームをデコードすると巨大になる
+func hugeGIF(t *testing.T, n, w, h int) []byte {
+	t.Helper()
+	var one bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White})
+	if err := gif.Encode(&one, frame, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := one.Bytes()
+	header := 13 + 3<<(data[10]&0x07+1)
+	if data[header] != 0x2C {
+		t.Fatalf("unexpected block 0x%02x after the header", data[header])
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:header])
+	for i := 0; i < n; i++ {
+		buf.Write(data[header : len(data)-1])
+	}
+	buf.WriteByte(0x3B)
+	return buf.Bytes()
+}
+
+func TestDecodeGIF(t *testing.T) {
+	animated := testGIF(t, 3, 10, 8)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		policy   GIFPolicy
+		wantErr  bool
+		animated bool
+	}{
+		{"animate", animated, GIFPolicy{Mode: GIFAnimate}, false, true},
+		{"still mode", animated, GIFPolicy{Mode: GIFStill}, false, false},
+		{"reject mode", animated, GIFPolicy{Mode: GIFReject}, true, false},
+		{"too many frames", animated, GIFPolicy{Mode: GIFAnimate, MaxFrames: 2}, false, false},
+		{"too many bytes", animated, GIFPolicy{Mode: GIFAnimate, MaxBytes: 10}, true, false},
+		{"within pixel budget", animated, GIFPolicy{Mode: GIFAnimate, MaxPixels: 240}, false, true},
+		{"frames over pixel budget", animated, GIFPolicy{Mode: GIFAnimate, MaxPixels: 200}, true, false},
+		{"still ignores frame budget", animated, GIFPolicy{Mode: GIFStill, MaxPixels: 80}, false, false},
+		{"canvas over pixel budget", animated, GIFPolicy{Mode: GIFStill, MaxPixels: 79}, true, false},
+		{"single frame", testGIF(t, 1, 4, 4), GIFPolicy{Mode: GIFAnimate}, false, false},
+		{"not a gif", []byte("not a gif"), GIFPolicy{Mode: GIFAnimate}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := decodeGIF(tt.data, tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeGIF() = %+v, want error", img)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeGIF() error = %v", err)
+			}
+			if img.Animated() != tt.animated {
+				t.Errorf("Animated() = %v, want %v", img.Animated(), tt.animated)
+			}
+			if got := img.Still.Bounds(); got.Dx() == 0 || got.Dy() == 0 {
+				t.Errorf("Still bounds = %v, want the canvas", got)
+			}
+			if img.Animated() && (len(img.Frames) != 3 || len(img.Delays) != 3 || img.Delays[0] != 50) {
+				t.Errorf("got %d frames and delays %v, want 3 frames of 50ms", len(img.Frames), img.Delays)
+			}
+		})
+	}
+}
+
+func TestDecodeGIFRejectsManyFramesBeforeDecoding(t *testing.T) {
+	data := hugeGIF(t, 300, 2000, 2000)
+	if len(data) > 2<<20 {
+		t.Fatalf("test GIF is %d bytes, want a small file", len(data))
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := decodeGIF(data, GIFPolicy{Mode: GIFAnimate, MaxPixels: 50000000})
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Fatal("decodeGIF() should reject a GIF whose frames exceed the pixel budget")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("decodeGIF() allocated %d bytes before rejecting", allocated)
+	}
+}
+
+func TestScanGIF(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		frames      int
+		framePixels int64
+		bounds      image.Rectangle
+	}{
+		{"encoded", testGIF(t, 3, 10, 8), 3, 240, image.Rect(0, 0, 10, 8)},
+		{"huge", hugeGIF(t, 300, 2000, 2000), 300, 300 * 2000 * 2000, image.Rect(0, 0, 2000, 2000)},
+		{"no frames", hugeGIF(t, 0, 5, 5), 0, 0, image.Rect(0, 0, 5, 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := scanGIF(tt.data)
+			if err != nil {
+				t.Fatalf("scanGIF() error = %v", err)
+			}
+			if layout.Frames != tt.frames || layout.FramePixels != tt.framePixels || layout.Bounds != tt.bounds {
+				t.Errorf("scanGIF() = %+v, want %d frames, %d pixels, %v", layout, tt.frames, tt.framePixels, tt.bounds)
+			}
+		})
+	}
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	img, err := decodeGIF(testGIF(t, 3, 10, 8), GIFPolicy{Mode: GIFAnimate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeAnimatedWebP(img.Frames, img.Delays, 2)
+	if err != nil {
+		t.Fatalf("EncodeAnimatedWebP() error = %v", err)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatalf("missing RIFF/WEBP header: %q", data[:12])
+	}
+	if size := binary.LittleEndian.Uint32(data[4:8]); int(size) != len(data)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(data)-8)
+	}
+
+	var chunks []string
+	var loopCount uint16
+	var width, height int
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		payload := data[pos+8 : pos+8+size]
+		switch fourCC {
+		case "VP8X":
+			width = int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16 + 1
+			height = int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16 + 1
+		case "ANIM":
+			loopCount = binary.LittleEndian.Uint16(payload[4:])
+		}
+		chunks = append(chunks, fourCC)
+		pos += 8 + size + size%2
+	}
+	want := []string{"VP8X", "ANIM", "ANMF", "ANMF", "ANMF"}
+	if len(chunks) != len(want) {
+		t.Fatalf("chunks = %v, want %v", chunks, want)
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Errorf("chunks = %v, want %v", chunks, want)
+			break
+		}
+	}
+	if width != 10 || height != 8 || loopCount != 2 {
+		t.Errorf("canvas %dx%d loop %d, want 10x8 loop 2", width, height, loopCount)
+	}
+
+	if _, err := EncodeAnimatedWebP(nil, nil, 0); err == nil {
+		t.Error("EncodeAnimatedWebP() with no frames should fail")
+	}
+}
@@ -0,0 +1,209 @@
+package extractor
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+)
+
+// 画像候補の出どころ
+const (
+	SourceMediaContent   = "media:content"
+	SourceMediaThumbnail = "media:thumbnail"
+	SourceFeedImage      = "item-image" // gofeed.Item.Image (RSSのimage, Atomのlogoなど)
+	SourceEnclosure      = "enclosure"
+	SourceImg            = "img"      // <img src>
+	SourceLazy           = "img-lazy" // <img data-src>などの遅延読み込み用の属性
+	SourceSrcset         = "srcset"
+)
+
+// lazyAttrs は遅延読み込みのプラグインが本来の画像URLを入れる属性
+var lazyAttrs = []string{"data-src", "data-lazy-src", "data-original", "data-lazy", "data-echo"}
+
+// ImageCandidate はアイテムから見つかった画像URLの候補。Width, Heightは宣言されていなければ0
+type ImageCandidate struct {
+	URL    string
+	Source string
+	Width  int
+	Height int
+}
+
+// ImageCandidates はアイテムのメディア拡張・添付ファイル・本文・説明文から画像の候補を集める。
+// フィードで明示された画像を先に、本文の画像を文書順に並べ、同じURLは最初の1件にまとめる。
+// URLはアイテムのリンクを基準に絶対URLにし、解決できないものとdata: URIは除く
+func ImageCandidates(item *gofeed.Item) []ImageCandidate {
+	base := itemBase(item.Link)
+	var candidates []ImageCandidate
+	candidates = append(candidates, mediaCandidates(item)...)
+	if item.Image != nil && item.Image.URL != "" {
+		candidates = append(candidates, ImageCandidate{URL: item.Image.URL, Source: SourceFeedImage})
+	}
+	for _, enclosure := range item.Enclosures {
+		if enclosure != nil && enclosure.URL != "" && strings.HasPrefix(enclosure.Type, "image/") {
+			candidates = append(candidates, ImageCandidate{URL: enclosure.URL, Source: SourceEnclosure})
+		}
+	}
+	candidates = resolveCandidates(base, candidates)
+	for _, content := range []string{item.Content, item.Description} {
+		if found, err := HTMLImageCandidates(content, base); err == nil {
+			candidates = append(candidates, found...)
+		}
+	}
+	return dedupeCandidates(candidates)
+}
+
+// mediaCandidates はMedia RSSのmedia:content (media:group内も含む) とmedia:thumbnailから画像の候補を返す
+func mediaCandidates(item *gofeed.Item) []ImageCandidate {
+	media := item.Extensions["media"]
+	if media == nil {
+		return nil
+	}
+	contents := media["content"]
+	thumbnails := media["thumbnail"]
+	for _, group := range media["group"] {
+		contents = append(contents, group.Children["content"]...)
+		thumbnails = append(thumbnails, group.Children["thumbnail"]...)
+	}
+
+	var candidates []ImageCandidate
+	for _, ext := range contents {
+		attrs := ext.Attrs
+		if attrs["url"] == "" {
+			continue
+		}
+		if medium := attrs["medium"]; medium != "" && medium != "image" {
+			continue
+		}
+		if typ := attrs["type"]; typ != "" && !strings.HasPrefix(typ, "image/") {
+			continue
+		}
+		candidates = append(candidates, ImageCandidate{
+			URL:    attrs["url"],
+			Source: SourceMediaContent,
+			Width:  atoi(attrs["width"]),
+			Height: atoi(attrs["height"]),
+		})
+	}
+	for _, ext := range thumbnails {
+		if ext.Attrs["url"] == "" {
+			continue
+		}
+		candidates = append(candidates, ImageCandidate{
+			URL:    ext.Attrs["url"],
+			Source: SourceMediaThumbnail,
+			Width:  atoi(ext.Attrs["width"]),
+			Height: atoi(ext.Attrs["height"]),
+		})
+	}
+	return candidates
+}
+
+// HTMLImageCandidates はHTML中の<img>からsrc, 遅延読み込み用の属性, srcsetの画像を文書順に返す。
+// URLはbase (HTML中に<base href>があればそれ) を基準に絶対URLにする
+func HTMLImageCandidates(content string, base *url.URL) ([]ImageCandidate, error) {
+	if !strings.Contains(content, "<") {
+		return nil, nil
+	}
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []ImageCandidate
+	var baseHref string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "img" {
+			candidates = append(candidates, imgCandidates(n)...)
+		}
+		if n.Type == html.ElementNode && n.Data == "base" && baseHref == "" {
+			baseHref = attr(n, "href")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return resolveCandidates(contentBase(base, baseHref), candidates), nil
+}
+
+// imgCandidates は1つの<img>の候補を返す。遅延読み込みの属性は、srcがプレースホルダーのことが多いためsrcより先に並べる
+func imgCandidates(n *html.Node) []ImageCandidate {
+	attrs := make(map[string]string, len(n.Attr))
+	for _, a := range n.Attr {
+		attrs[strings.ToLower(a.Key)] = strings.TrimSpace(a.Val)
+	}
+	width, height := atoi(attrs["width"]), atoi(attrs["height"])
+
+	var candidates []ImageCandidate
+	for _, key := range lazyAttrs {
+		if v := attrs[key]; v != "" {
+			candidates = append(candidates, ImageCandidate{URL: v, Source: SourceLazy, Width: width, Height: height})
+		}
+	}
+	for _, key := range []string{"srcset", "data-srcset", "data-lazy-srcset"} {
+		candidates = append(candidates, parseSrcset(attrs[key])...)
+	}
+	if v := attrs["src"]; v != "" {
+		candidates = append(candidates, ImageCandidate{URL: v, Source: SourceImg, Width: width, Height: height})
+	}
+	return candidates
+}
+
+// parseSrcset はsrcset属性を解析し、幅の指定 (800w) が大きい順に候補を返す
+func parseSrcset(srcset string) []ImageCandidate {
+	if srcset == "" {
+		return nil
+	}
+	var candidates []ImageCandidate
+	for _, entry := range strings.Split(srcset, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		c := ImageCandidate{URL: fields[0], Source: SourceSrcset}
+		if len(fields) > 1 && strings.HasSuffix(fields[1], "w") {
+			c.Width = atoi(strings.TrimSuffix(fields[1], "w"))
+		}
+		candidates = append(candidates, c)
+	}
+	// 幅の大きいものから並べる (挿入ソートで元の順序を保つ)
+	for i := 1; i < len(candidates); i++ {
+		for j := i; j > 0 && candidates[j].Width > candidates[j-1].Width; j-- {
+			candidates[j], candidates[j-1] = candidates[j-1], candidates[j]
+		}
+	}
+	return candidates
+}
+
+// dedupeCandidates は同じURLの候補を最初の1件にまとめる。後の候補にしかない寸法は引き継ぐ
+func dedupeCandidates(candidates []ImageCandidate) []ImageCandidate {
+	index := make(map[string]int, len(candidates))
+	var result []ImageCandidate
+	for _, c := range candidates {
+		if c.URL == "" {
+			continue
+		}
+		if i, ok := index[c.URL]; ok {
+			if result[i].Width == 0 && result[i].Height == 0 {
+				result[i].Width, result[i].Height = c.Width, c.Height
+			}
+			continue
+		}
+		index[c.URL] = len(result)
+		result = append(result, c)
+	}
+	return result
+}
+
+// atoi は寸法の属性を数値にする。"100%"や"auto"などは0を返す
+func atoi(s string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "px"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
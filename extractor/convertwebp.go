@@ -1,12 +1,15 @@
 package extractor
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"image"
 	_ "image/gif"  // Required to identify gif images
 	_ "image/jpeg" // This is required to decode jpeg images
 	_ "image/png"  // This is required to decode png images
+	"io"
+	"math"
 	"net/http"
 	"strings"
 	"time"
@@ -14,7 +17,12 @@ import (
 	webp "github.com/chai2010/webp"
 )
 
-func ConvertToWebP(url string) ([]byte, error) {
+// FetchImage は画像を取得してデコードする。GIFはgifsに従ってすべてのフレーム、または最初のフレームをデコードする
+func FetchImage(url string, gifs GIFPolicy) (*Image, error) {
+	if strings.HasPrefix(strings.ToLower(url), "data:") {
+		return nil, ErrDataURI
+	}
+
 	// カスタムHTTPクライアントを作成
 	timeout := time.Duration(5 * time.Second)
 	client := http.Client{
@@ -33,7 +41,12 @@ func ConvertToWebP(url string) ([]byte, error) {
 	// サポートされていないフォーマットの早期検出
 	contentType := resp.Header.Get("Content-Type")
 	if strings.Contains(contentType, "gif") {
-		return nil, errors.New("GIF画像はサポートされていません")
+		if gifs.Mode == GIFReject {
+			return nil, errors.New("GIF画像はサポートされていません")
+		}
+		if gifs.MaxBytes > 0 && resp.ContentLength > gifs.MaxBytes {
+			return nil, fmt.Errorf("GIF画像が大きすぎます: %dバイト", resp.ContentLength)
+		}
 	}
 
 	// 画像を取得
@@ -43,12 +56,30 @@ func ConvertToWebP(url string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
+	// Content-Typeに関わらず、先頭のシグネチャでGIFを判別する
+	body := bufio.NewReader(resp.Body)
+	if magic, _ := body.Peek(4); string(magic) == "GIF8" {
+		limit := gifs.MaxBytes
+		if limit <= 0 {
+			limit = math.MaxInt32
+		}
+		data, err := io.ReadAll(io.LimitReader(body, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("画像の取得時のエラー: %w", err)
+		}
+		return decodeGIF(data, gifs)
+	}
+
 	// 画像をデコード
-	img, _, err := image.Decode(resp.Body)
+	img, _, err := image.Decode(body)
 	if err != nil {
 		return nil, fmt.Errorf("画像のデコード時のエラー: %w", err)
 	}
+	return &Image{Still: img}, nil
+}
 
+// EncodeWebP はデコード済みの画像をWebPへ変換する
+func EncodeWebP(img image.Image) ([]byte, error) {
 	// webpに変換
 	quality := float32(85) // Or whatever quality level you want.
 	webpData, err := webp.EncodeRGB(img, quality)
@@ -0,0 +1,167 @@
+package extractor
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// 記事ページから見つけた画像候補の出どころ
+const (
+	SourceOGImage      = "og:image"
+	SourceTwitterImage = "twitter:image"
+	SourcePageImg      = "page-img" // 記事本文の要素内の<img>
+)
+
+// mainContentClasses は主要なブログサービス・テーマで記事本文を囲む要素のclass
+var mainContentClasses = []string{
+	"entry-content", "entry_content", "entry-body", "entry_body", "post-content", "post_content",
+	"post-body", "article-body", "article_body", "articlebody", "main-content",
+}
+
+// PageFetcher は記事ページを取得して代表画像の候補を探す
+type PageFetcher struct {
+	Client    *http.Client
+	UserAgent string
+	// 読み込むページの上限 (バイト)
+	MaxBytes int64
+}
+
+func NewPageFetcher(timeout time.Duration, maxBytes int64) *PageFetcher {
+	return &PageFetcher{Client: &http.Client{Timeout: timeout}, UserAgent: "Gofeed/1.0", MaxBytes: maxBytes}
+}
+
+// Fetch はpageURLのページを取得し、og:image, twitter:image, 記事本文中の画像を候補として返す
+func (f *PageFetcher) Fetch(pageURL string) ([]ImageCandidate, error) {
+	req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.UserAgent)
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("記事ページの取得に失敗しました: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("記事ページが非200ステータスを返しました: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return nil, fmt.Errorf("記事ページがHTMLではありません: %s", ct)
+	}
+	return PageImageCandidates(io.LimitReader(resp.Body, f.MaxBytes), resp.Request.URL)
+}
+
+// PageImageCandidates は記事ページのHTMLからog:image, twitter:image, 記事本文 (<article>, <main>や
+// entry-contentなどのclassを持つ要素) の最初の画像を、この順に候補として返す。URLはpageURLを基準に解決する
+func PageImageCandidates(r io.Reader, pageURL *url.URL) ([]ImageCandidate, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta []ImageCandidate
+	var content *html.Node
+	var baseHref string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "meta":
+				meta = appendMetaImage(meta, n)
+			case "base":
+				if baseHref == "" {
+					baseHref = attr(n, "href")
+				}
+			case "article", "main":
+				if content == nil {
+					content = n
+				}
+			default:
+				if content == nil && isMainContent(attr(n, "class")) {
+					content = n
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	candidates := meta
+	if content != nil {
+		var img func(*html.Node) []ImageCandidate
+		img = func(n *html.Node) []ImageCandidate {
+			if n.Type == html.ElementNode && n.Data == "img" {
+				return imgCandidates(n)
+			}
+			var found []ImageCandidate
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				found = append(found, img(c)...)
+			}
+			return found
+		}
+		for _, c := range img(content) {
+			c.Source = SourcePageImg
+			candidates = append(candidates, c)
+		}
+	}
+	return dedupeCandidates(resolveCandidates(contentBase(pageURL, baseHref), candidates)), nil
+}
+
+// appendMetaImage はog:image, twitter:imageのmetaを候補に加える。og:image:width/heightは直前のog:imageの寸法とする
+func appendMetaImage(candidates []ImageCandidate, n *html.Node) []ImageCandidate {
+	key := strings.ToLower(attr(n, "property"))
+	if key == "" {
+		key = strings.ToLower(attr(n, "name"))
+	}
+	value := strings.TrimSpace(attr(n, "content"))
+	if value == "" {
+		return candidates
+	}
+	switch key {
+	case "og:image", "og:image:url", "og:image:secure_url":
+		return append(candidates, ImageCandidate{URL: value, Source: SourceOGImage})
+	case "twitter:image", "twitter:image:src":
+		return append(candidates, ImageCandidate{URL: value, Source: SourceTwitterImage})
+	case "og:image:width", "og:image:height":
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if candidates[i].Source != SourceOGImage {
+				continue
+			}
+			if key == "og:image:width" {
+				candidates[i].Width = atoi(value)
+			} else {
+				candidates[i].Height = atoi(value)
+			}
+			break
+		}
+	}
+	return candidates
+}
+
+func isMainContent(class string) bool {
+	for _, name := range strings.Fields(strings.ToLower(class)) {
+		for _, c := range mainContentClasses {
+			if name == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.ToLower(a.Key) == key {
+			return a.Val
+		}
+	}
+	return ""
+}
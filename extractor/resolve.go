@@ -0,0 +1,91 @@
+package extractor
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrDataURI は画像がdata: URIで埋め込まれていることを表す。
+// 埋め込み画像はほとんどが遅延読み込みのプレースホルダーのため、取得・変換の対象にしない
+var ErrDataURI = errors.New("data: URIの画像は対象外です")
+
+// ResolveImageURL は画像のURLを絶対URLにする。相対URLはbaseを基準に解決する。rawはHTMLの属性やフィードから
+// 復号済みの値を渡す。&not=のようなクエリが別の文字に化けるため、HTMLエンティティは復号し直さない。
+// プロトコル相対URL (//cdn...) はbaseのスキーム、baseがなければhttpsを補う。
+// data: URIにはErrDataURIを、http(s)以外のURLや基準のない相対URLにはエラーを返す
+func ResolveImageURL(base *url.URL, raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("画像のURLが空です")
+	}
+	if strings.HasPrefix(strings.ToLower(raw), "data:") {
+		return "", ErrDataURI
+	}
+
+	ref, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("画像のURLを解析できません: %w", err)
+	}
+	if !ref.IsAbs() {
+		switch {
+		case base != nil:
+			ref = base.ResolveReference(ref)
+		case strings.HasPrefix(raw, "//"):
+			ref.Scheme = "https"
+		default:
+			return "", fmt.Errorf("相対URLの基準がありません: %q", raw)
+		}
+	}
+	if ref.Scheme != "http" && ref.Scheme != "https" {
+		return "", fmt.Errorf("対応していないスキームです: %q", raw)
+	}
+	if ref.Host == "" {
+		return "", fmt.Errorf("画像のURLにホストがありません: %q", raw)
+	}
+	ref.Fragment = ""
+	return ref.String(), nil
+}
+
+// itemBase はアイテムのリンクを相対URLの基準として返す。絶対URLでなければnilを返す
+func itemBase(link string) *url.URL {
+	base, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || !base.IsAbs() {
+		return nil
+	}
+	return base
+}
+
+// contentBase は本文に<base href>があれば、それをbaseで解決したものを基準として返す
+func contentBase(base *url.URL, href string) *url.URL {
+	href = strings.TrimSpace(href)
+	if href == "" {
+		return base
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return base
+	}
+	if base != nil {
+		return base.ResolveReference(ref)
+	}
+	if ref.IsAbs() {
+		return ref
+	}
+	return nil
+}
+
+// resolveCandidates は候補のURLをbaseで解決し、解決できないものとdata: URIを除く
+func resolveCandidates(base *url.URL, candidates []ImageCandidate) []ImageCandidate {
+	resolved := candidates[:0]
+	for _, c := range candidates {
+		u, err := ResolveImageURL(base, c.URL)
+		if err != nil {
+			continue
+		}
+		c.URL = u
+		resolved = append(resolved, c)
+	}
+	return resolved
+}
@@ -0,0 +1,74 @@
+package extractor
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestResolveImageURL(t *testing.T) {
+	base, _ := url.Parse("http://example.com/blog/post.html")
+
+	tests := []struct {
+		name    string
+		base    *url.URL
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"absolute", base, "https://cdn.example.com/a.jpg", "https://cdn.example.com/a.jpg", false},
+		{"relative", base, "img/a.jpg", "http://example.com/blog/img/a.jpg", false},
+		{"root relative", base, "/img/a.jpg", "http://example.com/img/a.jpg", false},
+		{"parent", base, "../a.jpg", "http://example.com/a.jpg", false},
+		{"protocol relative with base", base, "//cdn.example.com/a.jpg", "http://cdn.example.com/a.jpg", false},
+		{"protocol relative without base", nil, "//cdn.example.com/a.jpg", "https://cdn.example.com/a.jpg", false},
+		{"fragment", base, "a.jpg#x", "http://example.com/blog/a.jpg", false},
+		{"spaces", base, "  a.jpg  ", "http://example.com/blog/a.jpg", false},
+		{"already decoded not", base, "/a.jpg?a=1&not=2", "http://example.com/a.jpg?a=1&not=2", false},
+		{"already decoded copy", base, "/a.jpg?a=1&copy=3", "http://example.com/a.jpg?a=1&copy=3", false},
+		{"already decoded para", base, "/a.jpg?para=4&a=1", "http://example.com/a.jpg?para=4&a=1", false},
+		{"all legacy entity names", base, "/a.jpg?a=1&not=2&copy=3&para=4", "http://example.com/a.jpg?a=1&not=2&copy=3&para=4", false},
+		{"data uri", base, "data:image/gif;base64,R0lGOD", "", true},
+		{"empty", base, " ", "", true},
+		{"relative without base", nil, "a.jpg", "", true},
+		{"unsupported scheme", base, "javascript:alert(1)", "", true},
+		{"no host", nil, "http:///a.jpg", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveImageURL(tt.base, tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ResolveImageURL(%q) = %q, want error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveImageURL(%q) error = %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveImageURL(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImageURLDataURI(t *testing.T) {
+	if _, err := ResolveImageURL(nil, "data:image/gif;base64,R0lGOD"); !errors.Is(err, ErrDataURI) {
+		t.Errorf("ResolveImageURL(data:) error = %v, want ErrDataURI", err)
+	}
+}
+
+func TestHTMLImageCandidatesDecodesEntitiesOnce(t *testing.T) {
+	base, _ := url.Parse("https://example.com/posts/1")
+	content := `<p><img src="/a.jpg?a=1&amp;not=2&amp;copy=3&amp;para=4" width="640" height="480"></p>`
+
+	candidates, err := HTMLImageCandidates(content, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://example.com/a.jpg?a=1&not=2&copy=3&para=4"
+	if len(candidates) != 1 || candidates[0].URL != want {
+		t.Fatalf("HTMLImageCandidates() = %+v, want %q", candidates, want)
+	}
+}
@@ -0,0 +1,193 @@
+package extractor
+
+import (
+	"fmt"
+	"image"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ImagePolicy はアイテムの代表画像として使う画像の条件
+type ImagePolicy struct {
+	// 幅・高さがこれ未満の画像は使わない。宣言された寸法と、取得した画像の実際の寸法の両方で判定する
+	MinWidth  int
+	MinHeight int
+	// 長辺÷短辺がこれを超える画像 (横長のバナーなど) は使わない。0なら判定しない
+	MaxAspectRatio float64
+	// 既定の一覧に加えて除外するホスト。サブドメインも含む
+	BlockedHosts []string
+}
+
+// blockedHosts はアクセスカウンター・広告・アフィリエイト・ランキングのバナーや、アバター画像を配信するホスト
+var blockedHosts = []string{
+	// 広告・アフィリエイト
+	"doubleclick.net", "googlesyndication.com", "googleadservices.com", "amazon-adsystem.com",
+	"assoc-amazon.jp", "assoc-amazon.com", "a8.net", "valuecommerce.com", "valuecommerce.ne.jp",
+	"moshimo.com", "afl.rakuten.co.jp", "accesstrade.net", "felmat.net", "i-mobile.co.jp",
+	"nend.net", "microad.jp", "adingo.jp", "impact-ad.jp", "ad-stir.com",
+	// アクセスカウンター・解析
+	"counter.fc2.com", "counter1.fc2.com", "counter2.fc2.com", "analyzer.fc2.com", "blogranking.fc2.com",
+	"stats.wordpress.com", "pixel.wp.com", "feeds.feedburner.com", "ac.ebis.ne.jp", "ninja.co.jp",
+	"shinobi.jp", "accaii.com", "i2i.jp",
+	// ブログランキング・ソーシャルボタン
+	"blogmura.com", "with2.net", "blogranking.net", "b.hatena.ne.jp", "b.st-hatena.com",
+	"platform.twitter.com", "connect.facebook.net",
+	// アバター・絵文字
+	"gravatar.com", "s.w.org", "twemoji.maxcdn.com",
+}
+
+// rejectedNamePattern はカウンター・絵文字・バナー・ロゴ・プレースホルダーなどによく使われるファイル名・パス
+var rejectedNamePattern = regexp.MustCompile(`(^|[-_./])(spacer|blank|pixel|1x1|transparent|dummy|noimage|no_image|loading|lazy|` +
+	`counter|tracking|beacon|emoji|smiley|smilies|emoticons?|icon|favicon|avatar|logo|header|` +
+	`banner|bnr|btn|button|badge|rank|ranking|sns|arrow)([-_.0-9]|$)`)
+
+// wpSizePattern はWordPressがリサイズした画像のファイル名に付ける寸法 (-300x200.jpg)
+var wpSizePattern = regexp.MustCompile(`-(\d{2,4})x(\d{2,4})\.[a-z]+$`)
+
+// unsupportedExts はデコードできない、または代表画像に向かない拡張子
+var unsupportedExts = map[string]bool{".svg": true, ".ico": true, ".bmp": true, ".tif": true, ".tiff": true}
+
+// sourceScores は画像の出どころごとの基本点。フィードで明示された画像を本文中の画像より優先する
+var sourceScores = map[string]int{
+	SourceOGImage:        45,
+	SourceMediaContent:   40,
+	SourceTwitterImage:   40,
+	SourceEnclosure:      35,
+	SourceFeedImage:      30,
+	SourceLazy:           25,
+	SourceSrcset:         25,
+	SourceImg:            20,
+	SourcePageImg:        20,
+	SourceMediaThumbnail: 15,
+}
+
+// Reject は宣言された寸法とURLから候補を使わない理由を返す。使える場合は空文字を返す
+func (p ImagePolicy) Reject(c ImageCandidate) string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "URLを解析できません"
+	}
+	host := strings.ToLower(u.Hostname())
+	if hostBlocked(host, blockedHosts) || hostBlocked(host, p.BlockedHosts) {
+		return "除外するホストです: " + host
+	}
+
+	lowerPath := strings.ToLower(u.Path)
+	if unsupportedExts[path.Ext(lowerPath)] {
+		return "対応していない形式です: " + path.Ext(lowerPath)
+	}
+	if rejectedNamePattern.MatchString(lowerPath) {
+		return "除外するファイル名です: " + path.Base(lowerPath)
+	}
+
+	width, height := declaredSize(c)
+	if (width > 0 && width < p.MinWidth) || (height > 0 && height < p.MinHeight) {
+		return fmt.Sprintf("画像が小さすぎます: %dx%d", width, height)
+	}
+	if ratio := aspectRatio(width, height); p.MaxAspectRatio > 0 && ratio > p.MaxAspectRatio {
+		return fmt.Sprintf("縦横比が極端です: %dx%d", width, height)
+	}
+	return ""
+}
+
+// hostBlocked はhostがhostsのいずれか、またはそのサブドメインかを返す
+func hostBlocked(host string, hosts []string) bool {
+	for _, blocked := range hosts {
+		blocked = strings.ToLower(strings.TrimSpace(blocked))
+		if blocked != "" && (host == blocked || strings.HasSuffix(host, "."+blocked)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckImage は取得した画像の実際の寸法と縦横比を確認する
+func (p ImagePolicy) CheckImage(img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < p.MinWidth || height < p.MinHeight {
+		return fmt.Errorf("画像が小さすぎます: %dx%d", width, height)
+	}
+	if ratio := aspectRatio(width, height); p.MaxAspectRatio > 0 && ratio > p.MaxAspectRatio {
+		return fmt.Errorf("縦横比が極端です: %dx%d", width, height)
+	}
+	return nil
+}
+
+// Rank は使えない候補を除き、代表画像らしいものから順に並べる。同点の場合は元の順序 (文書順) を保つ
+func (p ImagePolicy) Rank(candidates []ImageCandidate) []ImageCandidate {
+	var ranked []ImageCandidate
+	var scores []int
+	for _, c := range candidates {
+		if p.Reject(c) != "" {
+			continue
+		}
+		ranked = append(ranked, c)
+		scores = append(scores, score(c))
+	}
+	sort.Stable(byScore{ranked, scores})
+	return ranked
+}
+
+type byScore struct {
+	candidates []ImageCandidate
+	scores     []int
+}
+
+func (s byScore) Len() int           { return len(s.candidates) }
+func (s byScore) Less(i, j int) bool { return s.scores[i] > s.scores[j] }
+func (s byScore) Swap(i, j int) {
+	s.candidates[i], s.candidates[j] = s.candidates[j], s.candidates[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+// score は出どころの基本点に、宣言された寸法が大きいほど (最大20点) 加点し、サムネイルと分かるものを減点する
+func score(c ImageCandidate) int {
+	s := sourceScores[c.Source]
+	width, height := declaredSize(c)
+	switch {
+	case width > 0 && height > 0:
+		s += min(width*height, 1200*800) / 48000
+	case width > 0:
+		s += min(width, 1200) / 60
+	}
+	if strings.Contains(strings.ToLower(c.URL), "thumb") {
+		s -= 10
+	}
+	return s
+}
+
+// declaredSize は候補の宣言された寸法を返す。宣言がなければWordPressのリサイズ画像のファイル名から読み取る
+func declaredSize(c ImageCandidate) (int, int) {
+	if c.Width > 0 || c.Height > 0 {
+		return c.Width, c.Height
+	}
+	if m := wpSizePattern.FindStringSubmatch(strings.ToLower(c.URL)); m != nil {
+		width, _ := strconv.Atoi(m[1])
+		height, _ := strconv.Atoi(m[2])
+		return width, height
+	}
+	return 0, 0
+}
+
+// aspectRatio は長辺÷短辺を返す。寸法が分からなければ0を返す
+func aspectRatio(width, height int) float64 {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	if width < height {
+		width, height = height, width
+	}
+	return float64(width) / float64(height)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
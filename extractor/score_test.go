@@ -0,0 +1,115 @@
+package extractor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImagePolicyReject(t *testing.T) {
+	policy := ImagePolicy{MinWidth: 200, MinHeight: 150, MaxAspectRatio: 3, BlockedHosts: []string{" Ads.Example.net "}}
+
+	tests := []struct {
+		name   string
+		c      ImageCandidate
+		reject bool
+	}{
+		{"plain", ImageCandidate{URL: "https://example.com/wp-content/uploads/2024/01/photo.jpg"}, false},
+		{"large enough", ImageCandidate{URL: "https://example.com/a.jpg", Width: 640, Height: 480}, false},
+		{"width only", ImageCandidate{URL: "https://example.com/a.jpg", Width: 640}, false},
+		{"default blocked host", ImageCandidate{URL: "https://counter.fc2.com/a.gif"}, true},
+		{"blocked subdomain", ImageCandidate{URL: "https://www.assoc-amazon.jp/e/ir?t=x"}, true},
+		{"similar host is not blocked", ImageCandidate{URL: "https://nota8.net/a.jpg"}, false},
+		{"configured host", ImageCandidate{URL: "https://img.ads.example.net/a.jpg"}, true},
+		{"svg", ImageCandidate{URL: "https://example.com/a.SVG"}, true},
+		{"spacer", ImageCandidate{URL: "https://example.com/img/spacer.gif"}, true},
+		{"emoji", ImageCandidate{URL: "https://example.com/images/emoji_1f600.png"}, true},
+		{"banner with number", ImageCandidate{URL: "https://example.com/banner_01.png"}, true},
+		{"name inside a word", ImageCandidate{URL: "https://example.com/headerless-photo-logos2024.jpg"}, false},
+		{"too narrow", ImageCandidate{URL: "https://example.com/a.jpg", Width: 100, Height: 300}, true},
+		{"too short", ImageCandidate{URL: "https://example.com/a.jpg", Width: 300, Height: 100}, true},
+		{"wordpress size", ImageCandidate{URL: "https://example.com/a-150x150.jpg"}, true},
+		{"declared size wins over file name", ImageCandidate{URL: "https://example.com/a-150x150.jpg", Width: 600, Height: 400}, false},
+		{"wide banner", ImageCandidate{URL: "https://example.com/a.jpg", Width: 728, Height: 200}, true},
+		{"tall banner", ImageCandidate{URL: "https://example.com/a.jpg", Width: 200, Height: 700}, true},
+		{"broken url", ImageCandidate{URL: "https://example.com/%zz"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := policy.Reject(tt.c)
+			if (reason != "") != tt.reject {
+				t.Errorf("Reject(%+v) = %q, want reject %v", tt.c, reason, tt.reject)
+			}
+		})
+	}
+}
+
+func TestImagePolicyRejectWithoutAspectRatio(t *testing.T) {
+	c := ImageCandidate{URL: "https://example.com/a.jpg", Width: 2000, Height: 200}
+	if reason := (ImagePolicy{}).Reject(c); reason != "" {
+		t.Errorf("Reject(%+v) = %q, want no limit when MaxAspectRatio is 0", c, reason)
+	}
+}
+
+func TestImagePolicyRank(t *testing.T) {
+	policy := ImagePolicy{MinWidth: 200, MinHeight: 150}
+
+	tests := []struct {
+		name       string
+		candidates []ImageCandidate
+		want       []string
+	}{
+		{"empty", nil, nil},
+		{
+			name: "source and size",
+			candidates: []ImageCandidate{
+				{URL: "https://example.com/a.jpg", Source: SourceImg},
+				{URL: "https://example.com/b.jpg", Source: SourceMediaContent},
+				{URL: "https://example.com/c.jpg", Source: SourceOGImage, Width: 1200, Height: 800},
+				{URL: "https://example.com/e-300x200.jpg", Source: SourceImg},
+			},
+			want: []string{
+				"https://example.com/c.jpg",
+				"https://example.com/b.jpg",
+				"https://example.com/e-300x200.jpg",
+				"https://example.com/a.jpg",
+			},
+		},
+		{
+			name: "rejected candidates are dropped",
+			candidates: []ImageCandidate{
+				{URL: "https://example.com/spacer.gif", Source: SourceMediaContent},
+				{URL: "https://example.com/a.jpg", Source: SourceImg, Width: 100, Height: 100},
+				{URL: "https://example.com/b.jpg", Source: SourceImg},
+			},
+			want: []string{"https://example.com/b.jpg"},
+		},
+		{
+			name: "thumbnails are ranked lower",
+			candidates: []ImageCandidate{
+				{URL: "https://example.com/thumb/a.jpg", Source: SourceMediaContent},
+				{URL: "https://example.com/b.jpg", Source: SourceEnclosure},
+			},
+			want: []string{"https://example.com/b.jpg", "https://example.com/thumb/a.jpg"},
+		},
+		{
+			name: "ties keep document order",
+			candidates: []ImageCandidate{
+				{URL: "https://example.com/1.jpg", Source: SourceImg},
+				{URL: "https://example.com/2.jpg", Source: SourcePageImg},
+				{URL: "https://example.com/3.jpg", Source: SourceImg},
+			},
+			want: []string{"https://example.com/1.jpg", "https://example.com/2.jpg", "https://example.com/3.jpg"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range policy.Rank(tt.candidates) {
+				got = append(got, c.URL)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rank() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
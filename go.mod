@@ -10,6 +10,10 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/mmcdole/gofeed v1.2.1
 	golang.org/x/net v0.10.0
+	golang.org/x/text v0.12.0
+	gopkg.in/yaml.v2 v2.4.0
+	gorm.io/driver/postgres v1.5.2
+	gorm.io/gorm v1.25.3
 )
 
 require (
@@ -50,8 +54,4 @@ require (
 	golang.org/x/arch v0.0.0-20190927153633-4e8777c89be4 // indirect
 	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/text v0.12.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gorm.io/driver/postgres v1.5.2 // indirect
-	gorm.io/gorm v1.25.3 // indirect
 )
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go-rss-sql/config"
+	"go-rss-sql/dbmanager"
+	"go-rss-sql/rssList"
+	"go-rss-sql/urlnorm"
+	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+type FeedResult struct {
+	URL    string
+	Source dbmanager.Feed // 取得対象のフィード (取得前の状態)
+	Feed   *gofeed.Feed
+	Err    error
+
+	// HTTPステータス (接続エラーなどで応答がない場合は0)
+	StatusCode int
+
+	// 条件付きGETの結果。NotModifiedがtrueの場合Feedはnil
+	NotModified  bool
+	ETag         string
+	LastModified string
+}
+
+// fetchFeed は前回取得時のETag・Last-Modifiedを付けてフィードを取得する。
+// 更新がなければ304を受け取り、解析を行わずに返す
+func fetchFeed(feed dbmanager.Feed) FeedResult {
+	url := feed.URL
+	customClient := &http.Client{
+		Timeout: 4 * time.Second,
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return FeedResult{URL: url, Source: feed, Err: err}
+	}
+	req.Header.Set("User-Agent", "Gofeed/1.0")
+	if feed.ETag != "" {
+		req.Header.Set("If-None-Match", feed.ETag)
+	}
+	if feed.LastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.LastModified)
+	}
+
+	resp, err := customClient.Do(req)
+	if err != nil {
+		return FeedResult{URL: url, Source: feed, Err: err}
+	}
+	defer resp.Body.Close()
+
+	result := FeedResult{
+		URL:          url,
+		Source:       feed,
+		StatusCode:   resp.StatusCode,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		result.NotModified = true
+		return result
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result.Err = gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+		return result
+	}
+
+	fp := gofeed.NewParser()
+	fp.RSSTranslator = &hintTranslator{}
+	parsed, err := fp.Parse(resp.Body)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Feed = parsed
+	return result
+}
+
+func runCrawl(args []string) error {
+	fs := flag.NewFlagSet("crawl", flag.ExitOnError)
+	var only stringList
+	fs.Var(&only, "feed", "指定したフィードURLのみ取得する (複数指定可)")
+	shardIndex := fs.Int("shard-index", cfg.Crawl.ShardIndex, "このプロセスが担当するシャード番号 (0始まり)")
+	shardCount := fs.Int("shard-count", cfg.Crawl.ShardCount, "フィードを分担するシャード数")
+	workers := fs.Int("workers", cfg.Crawl.Workers, "フィードを同時に取得する最大数")
+	perHost := fs.Int("per-host", cfg.Crawl.PerHost, "同一ホストから同時に取得する最大数")
+	fs.Parse(args)
+
+	crawlCfg := config.CrawlConfig{ShardIndex: *shardIndex, ShardCount: *shardCount, Workers: *workers, PerHost: *perHost}
+	if err := crawlCfg.Validate(); err != nil {
+		return err
+	}
+	if crawlCfg.ShardCount > 1 {
+		log.SetPrefix(fmt.Sprintf("[shard %d/%d] ", crawlCfg.ShardIndex, crawlCfg.ShardCount))
+	}
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+
+	var feeds []dbmanager.Feed
+	var stats crawlStats
+	if len(only) == 0 {
+		// 初回のみrssList.Rss_urlsからfeedsテーブルへ取り込む
+		imported, err := dbmanager.SeedFeedsIfEmpty(db, rssList.Rss_urls)
+		if err != nil {
+			log.Printf("フィード一覧の初期登録に失敗しました: %s", err)
+			return err
+		}
+		if imported > 0 {
+			log.Printf("rssList.Rss_urlsから%d件のフィードを登録しました", imported)
+		}
+
+		enabled, err := dbmanager.GetEnabledFeeds(db) // 有効なフィードを取得
+		if err != nil {
+			log.Printf("フィード一覧の取得に失敗しました: %s", err)
+			return err
+		}
+		now := time.Now()
+		for _, feed := range enabled {
+			if rssList.ShardOf(feed.URL, crawlCfg.ShardCount) != crawlCfg.ShardIndex {
+				continue
+			}
+			if feed.InBackoff(now) {
+				stats.BackedOff++
+				continue
+			}
+			feeds = append(feeds, feed)
+		}
+		log.Printf("有効なフィード数: %d (このシャードの担当: %d, バックオフ中: %d)", len(enabled), len(feeds), stats.BackedOff)
+	} else {
+		feeds, err = dbmanager.GetFeedsByURLs(db, only)
+		if err != nil {
+			return err
+		}
+		log.Printf("指定されたフィード数: %d", len(feeds))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	c := newCrawler(db)
+	c.stats = stats
+	c.stats.Feeds = len(feeds)
+	pool := newFetchPool(crawlCfg.Workers, crawlCfg.PerHost)
+	for feedResult := range pool.run(ctx, feeds, fetchFeed) {
+		c.handle(feedResult)
+	}
+	c.clusterNewItems()
+	c.logSummary(time.Since(start))
+	return nil
+}
+
+// crawlStats は1回のクロールの集計
+type crawlStats struct {
+	Feeds       int
+	Fetched     int
+	NotModified int
+	Failed      int
+	BackedOff   int
+	Disabled    int
+	NewItems    int
+	Comments    int
+}
+
+// crawler はフィードの取得結果をDBへ反映し、集計を保持する。crawlとdaemonで共用する
+type crawler struct {
+	db         *gorm.DB
+	policy     dbmanager.HealthPolicy
+	dates      dbmanager.DateParser
+	similarity dbmanager.SimilarityPolicy
+	images     *imageFinder
+	// links.fetch_canonicalが有効な場合のみ設定する
+	canonical *urlnorm.Resolver
+	stats     crawlStats
+	// 保存したアイテムのリンク。すべてのフィードを処理した後にまとめて類似記事を判定する
+	savedLinks []string
+}
+
+func newCrawler(db *gorm.DB) *crawler {
+	c := &crawler{
+		db:         db,
+		policy:     healthPolicy(),
+		dates:      dateParser(),
+		similarity: similarityPolicy(),
+		images:     newImageFinder(db),
+	}
+	if cfg.Links.FetchCanonical {
+		c.canonical = urlnorm.NewResolver(cfg.Links.FetchTimeout)
+	}
+	return c
+}
+
+// handle は1フィード分の取得結果を処理する
+func (c *crawler) handle(feedResult FeedResult) {
+	db := c.db
+	defer c.scheduleNext(feedResult)
+
+	if feedResult.Err != nil {
+		log.Printf("フィードの取得にエラーが発生しました: %s: %s", feedResult.URL, feedResult.Err)
+		c.stats.Failed++
+		disabled, err := dbmanager.RecordFeedFailure(db, feedResult.URL, feedResult.StatusCode, feedResult.Err, c.policy)
+		if err != nil {
+			log.Printf("フィードの失敗記録に失敗しました: %s", err)
+		}
+		if disabled {
+			log.Printf("連続%d回失敗したためフィードを無効にしました: %s", c.policy.DisableAfter, feedResult.URL)
+			c.stats.Disabled++
+		}
+		return
+	}
+	if err := dbmanager.RecordFeedSuccess(db, feedResult.URL, feedResult.StatusCode); err != nil {
+		log.Printf("フィードの成功記録に失敗しました: %s", err)
+	}
+	if feedResult.NotModified {
+		c.stats.NotModified++
+		return
+	}
+	c.stats.Fetched++
+
+	if err := dbmanager.UpdateFeedSiteLink(db, feedResult.URL, feedResult.Feed.Link); err != nil {
+		log.Printf("フィードのサイトリンク更新に失敗しました: %s", err)
+	}
+
+	newItems, err := c.processFeed(feedResult)
+	c.stats.NewItems += newItems
+	if err != nil {
+		log.Printf("データベースへの保存に失敗しました: %s", err)
+		return
+	}
+
+	// 保存まで完了した場合のみ次回の条件付きGETに使う値を記録する
+	if err := dbmanager.UpdateFeedValidators(db, feedResult.URL, feedResult.ETag, feedResult.LastModified); err != nil {
+		log.Printf("ETag・Last-Modifiedの保存に失敗しました: %s", err)
+	}
+}
+
+// scheduleNext は取得結果から次回の取得予定時刻を記録する
+func (c *crawler) scheduleNext(feedResult FeedResult) {
+	interval := nextPollInterval(feedResult, cfg.Daemon)
+	if err := dbmanager.ScheduleFeed(c.db, feedResult.URL, interval); err != nil {
+		log.Printf("次回取得時刻の保存に失敗しました: %s", err)
+	}
+}
+
+func (c *crawler) logSummary(elapsed time.Duration) {
+	stats := c.stats
+	log.Printf("担当フィード: %d, 取得成功: %d, 更新なし(304): %d, 取得失敗: %d, バックオフ中: %d, 自動無効化: %d, 新規アイテム: %d, コメント: %d",
+		stats.Feeds, stats.Fetched, stats.NotModified, stats.Failed, stats.BackedOff, stats.Disabled, stats.NewItems, stats.Comments)
+	log.Printf("所要時間: %s", elapsed)
+}
+
+// dateParser は設定から公開日時の解釈方法を組み立てる
+func dateParser() dbmanager.DateParser {
+	return dbmanager.DateParser{Layouts: cfg.Dates.Layouts, Location: cfg.Dates.Location()}
+}
+
+// healthPolicy は設定からフィードのバックオフ・自動無効化の方針を組み立てる
+func healthPolicy() dbmanager.HealthPolicy {
+	return dbmanager.HealthPolicy{
+		DisableAfter: cfg.Crawl.DisableAfter,
+		BackoffBase:  cfg.Crawl.BackoffBase,
+		BackoffMax:   cfg.Crawl.BackoffMax,
+	}
+}
+
+// similarityPolicy は設定から類似記事の判定条件を組み立てる
+func similarityPolicy() dbmanager.SimilarityPolicy {
+	return dbmanager.SimilarityPolicy{
+		Window:        cfg.Similarity.Window,
+		TitleDistance: cfg.Similarity.TitleDistance,
+		ImageDistance: cfg.Similarity.ImageDistance,
+	}
+}
+
+// processFeed は新規アイテムの画像をアップロードし、フィードの内容をDBへ保存する。
+// 戻り値はDBに存在しなかったアイテムの数
+func (c *crawler) processFeed(feedResult FeedResult) (int, error) {
+	log.Printf("フィードのタイトル: %s", feedResult.Feed.Title)
+	log.Printf("フィードタイプ: %s, バージョン: %s", feedResult.Feed.FeedType, feedResult.Feed.FeedVersion)
+
+	items := c.separateComments(feedResult)
+	dbmanager.ClearUnreliableGUIDs(items, feedResult.Feed.Link, feedResult.Feed.FeedLink, feedResult.URL)
+	records := make([]dbmanager.ItemRecord, len(items))
+	newItems := 0
+
+	// フィード内のアイテムの存在はまとめて1回のクエリで確認する
+	refs := make([]dbmanager.ItemRef, len(items))
+	for i, item := range items {
+		refs[i] = dbmanager.ItemRef{Link: urlnorm.Canonicalize(item.Link), GUID: item.GUID}
+	}
+	known, err := dbmanager.ExistingItems(c.db, feedResult.Feed.Link, refs)
+	if err != nil {
+		return 0, fmt.Errorf("データベースクエリ中にエラーが発生しました: %w", err)
+	}
+
+	// 保存時に除かれるフィード内の重複リンクは、画像をアップロードする前に除く
+	seen := make(map[string]bool)
+	for i, item := range items {
+		records[i] = c.processItem(feedResult.Feed.Link, item, known.Contains(refs[i]), seen)
+		if records[i].Status.ShouldSave() {
+			newItems++
+		}
+	}
+	if newItems > 0 {
+		_, err := dbmanager.SaveSiteAndFeedItems(c.db, feedResult.Feed.Title, feedResult.Feed.Link, records)
+		if err != nil {
+			return newItems, err
+		}
+		for _, record := range records {
+			if record.Status.ShouldSave() {
+				c.savedLinks = append(c.savedLinks, record.Link)
+			}
+		}
+	}
+	return newItems, nil
+}
+
+// separateComments はフィードのアイテムから記事のみを返し、コメントはフィードの設定に従って保存または無視する。
+// コメントフィードのアイテムはすべてコメントとして扱う
+func (c *crawler) separateComments(feedResult FeedResult) []*gofeed.Item {
+	kind := feedResult.Source.Kind
+	if kind == "" {
+		kind = dbmanager.FeedKindOf(feedResult.URL)
+	}
+
+	var articles []*gofeed.Item
+	var comments []dbmanager.CommentRecord
+	for _, item := range feedResult.Feed.Items {
+		if kind != dbmanager.FeedKindComment && !dbmanager.IsCommentItem(item) {
+			articles = append(articles, item)
+			continue
+		}
+		publishedAt, _ := c.dates.PublishedAt(item, time.Now())
+		comments = append(comments, dbmanager.CommentRecord{Item: item, PublishedAt: publishedAt})
+	}
+	if len(comments) == 0 {
+		return articles
+	}
+
+	if kind == dbmanager.FeedKindArticle && len(articles) == 0 {
+		log.Printf("すべてのアイテムがコメントのためコメントフィードとして記録します: %s", feedResult.URL)
+		if err := dbmanager.SetFeedKind(c.db, feedResult.URL, dbmanager.FeedKindComment); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+
+	c.stats.Comments += len(comments)
+	policy := feedResult.Source.CommentPolicy
+	if policy == "" {
+		policy = cfg.Comments.Policy
+	}
+	if policy != dbmanager.CommentPolicyStore {
+		log.Printf("コメント%d件を無視しました: %s", len(comments), feedResult.URL)
+		return articles
+	}
+	saved, err := dbmanager.SaveComments(c.db, feedResult.Feed.Link, comments)
+	if err != nil {
+		log.Printf("コメントの保存に失敗しました: %s", err)
+		return articles
+	}
+	log.Printf("コメントを保存しました: %d件 (新規: %d件)", len(comments), saved)
+	return articles
+}
+
+// clusterNewItems はこの実行で保存したアイテムを他サイトの類似記事とまとめる。
+// フィードごとではなく実行ごとに1回呼ぶ。失敗してもアイテムの保存には影響させない
+func (c *crawler) clusterNewItems() {
+	links := c.savedLinks
+	c.savedLinks = nil
+	if len(links) == 0 {
+		return
+	}
+	clustered, err := dbmanager.ClusterItemsByLink(c.db, links, c.similarity)
+	if err != nil {
+		log.Printf("類似記事の判定に失敗しました: %s", err)
+		return
+	}
+	if clustered > 0 {
+		log.Printf("他サイトの類似記事とまとめたアイテム数: %d", clustered)
+	}
+}
+
+// processItem は1アイテム分の存在確認と画像のアップロードを行い、その結果を返す。
+// existsはフィード単位でまとめて確認した結果。seenは同じフィードで処理済みのリンクのキーで、
+// リンクが空のアイテムやseenに含まれるアイテムは画像をアップロードせずに除く
+func (c *crawler) processItem(siteURL string, item *gofeed.Item, exists bool, seen map[string]bool) dbmanager.ItemRecord {
+	record := dbmanager.ItemRecord{Item: item, Link: urlnorm.Canonicalize(item.Link)}
+	if strings.TrimSpace(item.Link) == "" {
+		log.Printf("RSSアイテム '%s' にリンクがないため、スキップします。", item.Title)
+		record.Status = dbmanager.ItemStatusSkipped
+		return record
+	}
+
+	var err error
+	if !exists && c.canonical != nil {
+		// 記事ページのcanonicalが別のURLであれば、そのURLでも存在を確認する
+		canonical, resolveErr := c.canonical.Resolve(item.Link)
+		if resolveErr != nil {
+			log.Printf("canonical URLの取得に失敗しました: %s", resolveErr)
+		}
+		if canonical != record.Link {
+			record.Link = canonical
+			exists, err = dbmanager.ItemExists(c.db, siteURL, record.Link, "")
+		}
+	}
+	if err != nil {
+		log.Printf("データベースクエリ中にエラーが発生しました: %s", err)
+		record.Status = dbmanager.ItemStatusError
+		return record
+	}
+	if exists {
+		log.Printf("RSSアイテム '%s' は既にデータベースに存在します。アップロードおよび保存をスキップします。", item.Link)
+		record.Status = dbmanager.ItemStatusExisting
+		return record
+	}
+	key := urlnorm.Key(record.Link)
+	if seen[key] {
+		log.Printf("RSSアイテム '%s' はフィード内で重複しているため、スキップします。", item.Link)
+		record.Status = dbmanager.ItemStatusSkipped
+		return record
+	}
+	seen[key] = true
+
+	log.Printf("RSSアイテム '%s' はデータベースに存在しないため、アップロードおよび保存を行います。", item.Link)
+	// 公開日が得られなかった場合は取得時刻を使い、推定値であることを記録する
+	record.PublishedAt, record.PublishedInferred = c.dates.PublishedAt(item, time.Now())
+	publishedDate := record.PublishedAt.Format(time.RFC3339)
+	if record.PublishedInferred {
+		publishedDate = "不明"
+	}
+	log.Printf("アイテムタイトル: %s, リンク: %s, 公開日: %s, タグ: %s", item.Title, record.Link, publishedDate, strings.Join(dbmanager.NormalizeTags(item.Categories), ", "))
+
+	uploaded, err := c.images.upload(item, record.Link)
+	if errors.Is(err, errNoImage) {
+		record.Status = dbmanager.ItemStatusNoImage
+		return record
+	}
+	if err != nil {
+		log.Printf("%s", err)
+		record.Status = dbmanager.ItemStatusImageFailed
+		return record
+	}
+	record.ImageURL = uploaded.URL
+	record.ImageHash = uploaded.Hash
+	record.Status = dbmanager.ItemStatusNew
+	return record
+}
+
+// stringList は同じフラグを複数回指定できるようにする
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
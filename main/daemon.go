@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go-rss-sql/config"
+	"go-rss-sql/dbmanager"
+	"go-rss-sql/rssList"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runDaemon は常駐し、取得予定時刻を過ぎたフィードを順次取得する。
+// SIGTERM/SIGINTを受けると新たな取得を止め、取得中のフィードを処理し終えてから終了する
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	shardIndex := fs.Int("shard-index", cfg.Crawl.ShardIndex, "このプロセスが担当するシャード番号 (0始まり)")
+	shardCount := fs.Int("shard-count", cfg.Crawl.ShardCount, "フィードを分担するシャード数")
+	workers := fs.Int("workers", cfg.Crawl.Workers, "フィードを同時に取得する最大数")
+	perHost := fs.Int("per-host", cfg.Crawl.PerHost, "同一ホストから同時に取得する最大数")
+	tick := fs.Duration("tick", cfg.Daemon.Tick, "取得予定のフィードを確認する間隔")
+	fs.Parse(args)
+
+	crawlCfg := config.CrawlConfig{ShardIndex: *shardIndex, ShardCount: *shardCount, Workers: *workers, PerHost: *perHost}
+	if err := crawlCfg.Validate(); err != nil {
+		return err
+	}
+	if crawlCfg.ShardCount > 1 {
+		log.SetPrefix(fmt.Sprintf("[shard %d/%d] ", crawlCfg.ShardIndex, crawlCfg.ShardCount))
+	}
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+	if imported, err := dbmanager.SeedFeedsIfEmpty(db, rssList.Rss_urls); err != nil {
+		return fmt.Errorf("フィード一覧の初期登録に失敗しました: %w", err)
+	} else if imported > 0 {
+		log.Printf("rssList.Rss_urlsから%d件のフィードを登録しました", imported)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("デーモンモードで起動しました (確認間隔: %s)", *tick)
+	c := newCrawler(db)
+	pool := newFetchPool(crawlCfg.Workers, crawlCfg.PerHost)
+	for {
+		due, err := dbmanager.GetDueFeeds(db, time.Now())
+		if err != nil {
+			log.Printf("取得予定のフィードの確認に失敗しました: %s", err)
+		}
+		var feeds []dbmanager.Feed
+		for _, feed := range due {
+			if rssList.ShardOf(feed.URL, crawlCfg.ShardCount) == crawlCfg.ShardIndex {
+				feeds = append(feeds, feed)
+			}
+		}
+
+		if len(feeds) > 0 {
+			start := time.Now()
+			c.stats = crawlStats{Feeds: len(feeds)}
+			for feedResult := range pool.run(ctx, feeds, fetchFeed) {
+				c.handle(feedResult)
+			}
+			c.clusterNewItems()
+			c.logSummary(time.Since(start))
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("終了シグナルを受信したため停止します")
+			return nil
+		case <-time.After(*tick):
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go-rss-sql/dbmanager"
+	"go-rss-sql/discovery"
+	"go-rss-sql/opml"
+	"go-rss-sql/rssList"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const feedsUsage = `使い方: go-rss-sql feeds <add|remove|list|enable|disable|import|health> [オプション] [URL...]
+       go-rss-sql feeds comments <store|ignore|default> URL...
+       go-rss-sql feeds discover [-dry-run] トップページURL...
+       go-rss-sql feeds import-opml ファイル
+       go-rss-sql feeds export-opml [-seed] [-o ファイル]`
+
+func runFeeds(args []string) error {
+	if len(args) == 0 {
+		return errors.New(feedsUsage)
+	}
+	sub, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("feeds "+sub, flag.ExitOnError)
+	disabledOnly := false
+	if sub == "list" {
+		fs.BoolVar(&disabledOnly, "disabled", false, "無効なフィードのみ表示する")
+	}
+	dryRun := false
+	timeout := 10 * time.Second
+	if sub == "discover" {
+		fs.BoolVar(&dryRun, "dry-run", false, "候補を表示するのみで登録しない")
+		fs.DurationVar(&timeout, "timeout", timeout, "ページ・フィード1件あたりの取得タイムアウト")
+	}
+	fromSeed := false
+	output := ""
+	if sub == "export-opml" {
+		fs.BoolVar(&fromSeed, "seed", false, "DBではなくrssList.Rss_urlsを書き出す")
+		fs.StringVar(&output, "o", "", "書き出すファイル (省略時は標準出力)")
+	}
+	fs.Parse(args)
+	urls := fs.Args()
+
+	var commentPolicy string
+	if sub == "comments" {
+		if len(urls) == 0 {
+			return errors.New(feedsUsage)
+		}
+		commentPolicy, urls = urls[0], urls[1:]
+		switch commentPolicy {
+		case dbmanager.CommentPolicyStore, dbmanager.CommentPolicyIgnore:
+		case "default":
+			commentPolicy = ""
+		default:
+			return fmt.Errorf("コメントの扱いは store, ignore, default のいずれかを指定してください: %q", commentPolicy)
+		}
+	}
+
+	switch sub {
+	case "add", "remove", "enable", "disable", "comments", "discover":
+		if len(urls) == 0 {
+			return fmt.Errorf("feeds %s にはURLを1つ以上指定してください", sub)
+		}
+	case "import-opml":
+		if len(urls) != 1 {
+			return errors.New("使い方: go-rss-sql feeds import-opml ファイル")
+		}
+	case "export-opml":
+		if fromSeed {
+			return exportOPML(nil, output)
+		}
+	case "list", "import", "health":
+	default:
+		return fmt.Errorf("不明なサブコマンドです: feeds %s\n%s", sub, feedsUsage)
+	}
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "add":
+		n, err := dbmanager.ImportFeedURLs(db, urls)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d件のフィードを登録しました", n)
+	case "remove":
+		n, err := dbmanager.RemoveFeeds(db, urls)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d件のフィードを削除しました", n)
+	case "enable", "disable":
+		n, err := dbmanager.SetFeedsEnabled(db, urls, sub == "enable")
+		if err != nil {
+			return err
+		}
+		log.Printf("%d件のフィードを更新しました", n)
+	case "comments":
+		n, err := dbmanager.SetFeedsCommentPolicy(db, urls, commentPolicy)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d件のフィードを更新しました", n)
+	case "discover":
+		return discoverFeeds(db, urls, timeout, dryRun)
+	case "import-opml":
+		return importOPML(db, urls[0])
+	case "export-opml":
+		return exportOPML(db, output)
+	case "import":
+		n, err := dbmanager.ImportFeedURLs(db, rssList.Rss_urls)
+		if err != nil {
+			return err
+		}
+		log.Printf("rssList.Rss_urlsから%d件のフィードを登録しました", n)
+	case "list":
+		feeds, err := dbmanager.ListFeeds(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tENABLED\tKIND\tGROUP\tURL\tSITE\tNOTES")
+		for _, feed := range feeds {
+			if disabledOnly && feed.Enabled {
+				continue
+			}
+			fmt.Fprintf(w, "%d\t%t\t%s\t%s\t%s\t%s\t%s\n", feed.ID, feed.Enabled, feed.Kind, feed.Group, feed.URL, feed.SiteLink, feed.Notes)
+		}
+		return w.Flush()
+	case "health":
+		feeds, err := dbmanager.GetUnhealthyFeeds(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tENABLED\tFAILURES\tSTATUS\tLAST SUCCESS\tNEXT ATTEMPT\tURL\tLAST ERROR")
+		for _, feed := range feeds {
+			fmt.Fprintf(w, "%d\t%t\t%d\t%d\t%s\t%s\t%s\t%s\n", feed.ID, feed.Enabled, feed.ConsecutiveFailures, feed.LastStatus,
+				formatTime(feed.LastSuccessAt), formatTime(feed.NextAttemptAt), feed.URL, feed.LastError)
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// discoverFeeds はトップページからフィードを探し、最も良い記事のフィードを登録する
+func discoverFeeds(db *gorm.DB, homepages []string, timeout time.Duration, dryRun bool) error {
+	d := discovery.NewDiscoverer(timeout)
+	registered := 0
+	for _, homepage := range homepages {
+		candidates, err := d.Discover(homepage)
+		if len(candidates) > 0 {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "URL\tSOURCE\tKIND\tITEMS\tTITLE\tERROR")
+			for _, c := range candidates {
+				errText := ""
+				if c.Err != nil {
+					errText = c.Err.Error()
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", c.URL, c.Source, c.Kind, c.Items, c.Title, errText)
+			}
+			w.Flush()
+		}
+		if err != nil {
+			log.Printf("%s: %s", homepage, err)
+			continue
+		}
+
+		best, ok := discovery.Best(candidates)
+		if !ok {
+			log.Printf("記事のフィードが見つかりませんでした: %s", homepage)
+			continue
+		}
+		if dryRun {
+			log.Printf("[dry-run] 登録するフィード: %s", best.URL)
+			continue
+		}
+		n, err := dbmanager.ImportFeedURLs(db, []string{best.URL})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			log.Printf("フィードは登録済みです: %s", best.URL)
+			continue
+		}
+		log.Printf("フィードを登録しました: %s", best.URL)
+		registered += n
+	}
+	log.Printf("%d件のフィードを登録しました", registered)
+	return nil
+}
+
+// importOPML はOPMLファイルのフィードをフォルダをグループとして登録する
+func importOPML(db *gorm.DB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("OPMLファイルを開けません: %w", err)
+	}
+	defer f.Close()
+	entries, err := opml.Parse(f)
+	if err != nil {
+		return err
+	}
+
+	imports := make([]dbmanager.FeedImport, len(entries))
+	for i, e := range entries {
+		imports[i] = dbmanager.FeedImport{URL: e.URL, Group: e.Group, Enabled: e.Enabled}
+	}
+	added, grouped, err := dbmanager.ImportFeeds(db, imports)
+	if err != nil {
+		return err
+	}
+	log.Printf("OPMLのフィード%d件のうち、%d件を新規に登録し、登録済みの%d件にグループを設定しました", len(entries), added, grouped)
+	return nil
+}
+
+// exportOPML はフィード一覧をOPMLとして書き出す。dbがnilの場合はrssList.Rss_urlsを書き出す
+func exportOPML(db *gorm.DB, path string) error {
+	var entries []opml.Entry
+	if db == nil {
+		for _, url := range rssList.Rss_urls {
+			entries = append(entries, opml.Entry{URL: url, Enabled: true})
+		}
+	} else {
+		feeds, err := dbmanager.ListFeeds(db)
+		if err != nil {
+			return err
+		}
+		siteLinks := make([]string, 0, len(feeds))
+		for _, feed := range feeds {
+			siteLinks = append(siteLinks, feed.SiteLink)
+		}
+		names, err := dbmanager.SiteNamesByURL(db, siteLinks)
+		if err != nil {
+			return err
+		}
+		for _, feed := range feeds {
+			entries = append(entries, opml.Entry{
+				URL:     feed.URL,
+				Title:   names[feed.SiteLink],
+				SiteURL: feed.SiteLink,
+				Group:   feed.Group,
+				Enabled: feed.Enabled,
+			})
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("OPMLファイルを作成できません: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := opml.Write(w, "go-rss-sql feeds", entries); err != nil {
+		return err
+	}
+	if path != "" {
+		log.Printf("%d件のフィードを%sへ書き出しました", len(entries), path)
+	}
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go-rss-sql/dbmanager"
+	"go-rss-sql/extractor"
+	"go-rss-sql/similarity"
+	"go-rss-sql/uploader"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// errNoImage はアイテムに使える画像の候補がないことを表す
+var errNoImage = errors.New("画像の候補がありません")
+
+// uploadedImage はアップロードした画像の公開URLと、重複検出に使う知覚ハッシュ
+type uploadedImage struct {
+	URL  string
+	Hash uint64
+}
+
+// uploadImage は画像を取得して寸法を確認し、WebPへ変換してS3へアップロードし、公開URLを返す。
+// GIFアニメーションはimages.gifの設定に従ってアニメーションWebPまたは静止画にする
+func (f *imageFinder) uploadImage(imageURL string) (uploadedImage, error) {
+	img, err := extractor.FetchImage(imageURL, f.gifs)
+	if err != nil {
+		return uploadedImage{}, fmt.Errorf("WebPへの画像変換に失敗しました: %w", err)
+	}
+	if err := f.policy.CheckImage(img.Still); err != nil {
+		return uploadedImage{}, err
+	}
+	webpImage, err := img.WebP()
+	if err != nil {
+		return uploadedImage{}, fmt.Errorf("WebPへの画像変換に失敗しました: %w", err)
+	}
+
+	objectKey := "photo/" + uuid.New().String() + ".webp"
+	objectURL, err := uploader.UploadToS3(f.uploadOpts, objectKey, webpImage)
+	if err != nil {
+		return uploadedImage{}, fmt.Errorf("S3への画像アップロードに失敗しました: %w", err)
+	}
+	if img.Animated() {
+		log.Printf("S3へアニメーション画像 (%dフレーム) をアップロードしました: %s", len(img.Frames), objectKey)
+	} else {
+		log.Printf("S3へ画像をアップロードしました: %s", objectKey)
+	}
+	return uploadedImage{URL: objectURL, Hash: similarity.ImageHash(img.Still)}, nil
+}
+
+// maxImageAttempts は1件のアイテムで取得・変換を試す画像候補の上限
+const maxImageAttempts = 3
+
+// uploadCandidates は画像候補を点数順に試し、最初にアップロードできた画像を返す。
+// 使える候補がなければ errNoImage を返す
+func (f *imageFinder) uploadCandidates(candidates []extractor.ImageCandidate) (uploadedImage, error) {
+	usable := f.policy.Rank(candidates)
+	if len(usable) == 0 {
+		return uploadedImage{}, errNoImage
+	}
+	if len(usable) > maxImageAttempts {
+		usable = usable[:maxImageAttempts]
+	}
+	var lastErr error
+	for _, c := range usable {
+		uploaded, err := f.uploadImage(c.URL)
+		if err == nil {
+			return uploaded, nil
+		}
+		log.Printf("画像候補 %s (%s) を使用できません: %s", c.URL, c.Source, err)
+		lastErr = err
+	}
+	return uploadedImage{}, lastErr
+}
+
+// imageFinder はアイテムの代表画像を選んでアップロードする。crawlとreprocess-imagesで共用する
+type imageFinder struct {
+	db         *gorm.DB
+	policy     extractor.ImagePolicy
+	gifs       extractor.GIFPolicy
+	uploadOpts uploader.Options
+	// images.fetch_pageが有効な場合のみ設定する
+	pages *extractor.PageFetcher
+}
+
+func newImageFinder(db *gorm.DB) *imageFinder {
+	f := &imageFinder{db: db, policy: imagePolicy(), gifs: gifPolicy(), uploadOpts: uploadOptions()}
+	if cfg.Images.FetchPage {
+		f.pages = extractor.NewPageFetcher(cfg.Images.PageTimeout, cfg.Images.PageMaxBytes)
+	}
+	return f
+}
+
+// upload はフィードの画像候補を試し、使えるものがなければ記事ページ (link) の画像を試す
+func (f *imageFinder) upload(item *gofeed.Item, link string) (uploadedImage, error) {
+	uploaded, err := f.uploadCandidates(extractor.ImageCandidates(item))
+	if err == nil || f.pages == nil {
+		return uploaded, err
+	}
+	uploaded, pageErr := f.fromPage(link)
+	if pageErr == nil {
+		return uploaded, nil
+	}
+	// 記事ページにも画像がなければ、フィードの画像候補での失敗を返す
+	if errors.Is(pageErr, errNoImage) {
+		return uploadedImage{}, err
+	}
+	return uploadedImage{}, pageErr
+}
+
+// fromPage は記事ページから代表画像を探してアップロードする。ページの取得結果はURLごとに保存し、
+// 保存済みであれば取得し直さない
+func (f *imageFinder) fromPage(link string) (uploadedImage, error) {
+	cached, err := dbmanager.CachedPageImage(f.db, link, cfg.Images.PageRetry)
+	if err != nil {
+		return uploadedImage{}, err
+	}
+	if cached == nil {
+		page := dbmanager.PageImage{URL: link, FetchedAt: time.Now()}
+		candidates, fetchErr := f.pages.Fetch(link)
+		if fetchErr != nil {
+			page.Error = fetchErr.Error()
+		} else if ranked := f.policy.Rank(candidates); len(ranked) > 0 {
+			page.ImageURL = ranked[0].URL
+			page.Source = ranked[0].Source
+		}
+		if err := dbmanager.SavePageImage(f.db, page); err != nil {
+			log.Printf("%s", err)
+		}
+		if fetchErr != nil {
+			return uploadedImage{}, fetchErr
+		}
+		cached = &page
+	}
+	if cached.ImageURL == "" {
+		return uploadedImage{}, errNoImage
+	}
+	log.Printf("記事ページの画像を使用します: %s (%s)", cached.ImageURL, cached.Source)
+	return f.uploadImage(cached.ImageURL)
+}
+
+func runReprocessImages(args []string) error {
+	fs := flag.NewFlagSet("reprocess-images", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "処理するアイテムの最大数")
+	siteID := fs.Uint("site", 0, "対象をこのサイトIDのアイテムに限定する")
+	dryRun := fs.Bool("dry-run", false, "アップロード・更新を行わず対象のみ表示する")
+	fs.Parse(args)
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+
+	query := db.Where("imgurl = ''").Order("id desc").Limit(*limit)
+	if *siteID != 0 {
+		query = query.Where("site_id = ?", *siteID)
+	}
+	var items []dbmanager.Rss
+	if err := query.Find(&items).Error; err != nil {
+		return fmt.Errorf("画像未設定アイテムの取得に失敗しました: %w", err)
+	}
+	log.Printf("画像未設定のアイテム数: %d", len(items))
+
+	finder := newImageFinder(db)
+	updated := 0
+	for _, item := range items {
+		stored, err := dbmanager.StoredItem(db, item)
+		if err != nil {
+			log.Printf("%s: %s", item.Link, err)
+			continue
+		}
+		if *dryRun {
+			candidates := finder.policy.Rank(extractor.ImageCandidates(stored))
+			switch {
+			case len(candidates) > 0:
+				log.Printf("対象: %s -> %s (%s)", item.Link, candidates[0].URL, candidates[0].Source)
+			case finder.pages != nil:
+				log.Printf("対象: %s -> 記事ページの画像", item.Link)
+			}
+			continue
+		}
+
+		uploaded, err := finder.upload(stored, item.Link)
+		if errors.Is(err, errNoImage) {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s: %s", item.Link, err)
+			continue
+		}
+		err = db.Model(&item).Updates(map[string]interface{}{
+			"imgurl":     uploaded.URL,
+			"image_hash": dbmanager.HashValue(uploaded.Hash),
+		}).Error
+		if err != nil {
+			log.Printf("画像URLの更新に失敗しました: %s", err)
+			continue
+		}
+		updated++
+	}
+	log.Printf("画像を更新したアイテム数: %d", updated)
+	return nil
+}
+
+// imagePolicy は設定から代表画像を選ぶ条件を組み立てる
+func imagePolicy() extractor.ImagePolicy {
+	return extractor.ImagePolicy{
+		MinWidth:       cfg.Images.MinWidth,
+		MinHeight:      cfg.Images.MinHeight,
+		MaxAspectRatio: cfg.Images.MaxAspectRatio,
+		BlockedHosts:   cfg.Images.BlockedHosts,
+	}
+}
+
+// gifPolicy は設定からGIF画像の変換方法を組み立てる
+func gifPolicy() extractor.GIFPolicy {
+	return extractor.GIFPolicy{
+		Mode:      cfg.Images.GIF,
+		MaxFrames: cfg.Images.GIFMaxFrames,
+		MaxBytes:  cfg.Images.GIFMaxBytes,
+		MaxPixels: cfg.Images.GIFMaxPixels,
+	}
+}
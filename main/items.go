@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go-rss-sql/dbmanager"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const itemsUsage = `使い方: go-rss-sql items <list|dedupe|cluster|similar|split-comments> [オプション]`
+
+func runItems(args []string) error {
+	if len(args) == 0 {
+		return errors.New(itemsUsage)
+	}
+	switch args[0] {
+	case "list":
+		return runItemsList(args[1:])
+	case "dedupe":
+		return runItemsDedupe(args[1:])
+	case "cluster":
+		return runItemsCluster(args[1:])
+	case "similar":
+		return runItemsSimilar(args[1:])
+	case "split-comments":
+		return runItemsSplitComments(args[1:])
+	}
+	return fmt.Errorf("不明なサブコマンドです: items %s\n%s", args[0], itemsUsage)
+}
+
+func runItemsList(args []string) error {
+	fs := flag.NewFlagSet("items list", flag.ExitOnError)
+	limit := fs.Int("limit", 50, "表示する最大件数")
+	siteID := fs.Uint("site", 0, "このサイトIDのアイテムのみ表示する")
+	noImage := fs.Bool("no-image", false, "画像が未設定のアイテムのみ表示する")
+	tag := fs.String("tag", "", "このタグが付いたアイテムのみ表示する")
+	collapse := fs.Bool("collapse", false, "他サイトの同じ記事は代表の1件のみ表示する")
+	fs.Parse(args)
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+
+	query := db.Order("published_at desc").Limit(*limit)
+	if *siteID != 0 {
+		query = query.Where("site_id = ?", *siteID)
+	}
+	if *noImage {
+		query = query.Where("imgurl = ''")
+	}
+	if *tag != "" {
+		query = dbmanager.WhereTag(query, *tag)
+	}
+	if *collapse {
+		query = dbmanager.WhereRepresentative(query)
+	}
+	var items []dbmanager.Rss
+	if err := query.Find(&items).Error; err != nil {
+		return fmt.Errorf("アイテムの取得に失敗しました: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSITE\tPUBLISHED\tTITLE\tLINK\tIMAGE")
+	for _, item := range items {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", item.ID, item.SiteID, item.PublishedAt.Format("2006-01-02 15:04"), item.Title, item.Link, item.Imgurl)
+	}
+	return w.Flush()
+}
+
+// runItemsDedupe は既存アイテムのリンクを現在の正規化ルールで計算し直し、重複を統合する
+func runItemsDedupe(args []string) error {
+	fs := flag.NewFlagSet("items dedupe", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "件数の確認のみ行い、DBを変更しない")
+	fs.Parse(args)
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+	result, err := dbmanager.RebuildLinkKeys(db, *dryRun)
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if *dryRun {
+		prefix = "[dry-run] "
+	}
+	log.Printf("%s対象アイテム: %d, キー更新: %d, 重複統合: %d", prefix, result.Items, result.Rekeyed, result.Merged)
+	return nil
+}
+
+// runItemsCluster は既存アイテムのうち他サイトの類似記事とまとめられていないものを判定し直す
+func runItemsCluster(args []string) error {
+	fs := flag.NewFlagSet("items cluster", flag.ExitOnError)
+	since := fs.Duration("since", 30*24*time.Hour, "この期間内に公開されたアイテムを対象にする")
+	fs.Parse(args)
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+	clustered, err := dbmanager.ClusterUnassigned(db, time.Now().Add(-*since), similarityPolicy())
+	if err != nil {
+		return err
+	}
+	log.Printf("他サイトの類似記事とまとめたアイテム数: %d", clustered)
+	return nil
+}
+
+// runItemsSimilar は指定したアイテムと同じ記事を投稿している他サイトのアイテムを表示する
+func runItemsSimilar(args []string) error {
+	fs := flag.NewFlagSet("items similar", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("使い方: go-rss-sql items similar <アイテムID>")
+	}
+	id, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("アイテムIDが数値ではありません: %q", fs.Arg(0))
+	}
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+	posted, err := dbmanager.AlsoPostedBy(db, uint(id))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSITE\tPUBLISHED\tTITLE\tLINK")
+	for _, item := range posted {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", item.RssID, item.SiteName, item.PublishedAt.Format("2006-01-02 15:04"), item.Title, item.Link)
+	}
+	return w.Flush()
+}
+
+// runItemsSplitComments は記事として保存されていたコメントをcommentsテーブルへ移す
+func runItemsSplitComments(args []string) error {
+	fs := flag.NewFlagSet("items split-comments", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "件数の確認のみ行い、DBを変更しない")
+	fs.Parse(args)
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+	moved, err := dbmanager.MoveCommentItems(db, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("[dry-run] commentsへ移すアイテム数: %d", moved)
+		return nil
+	}
+	log.Printf("commentsへ移したアイテム数: %d", moved)
+	return nil
+}
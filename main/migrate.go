@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-rss-sql/dbmanager"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+const migrateUsage = `使い方: go-rss-sql migrate [up|down [-steps N]|status]`
+
+func runMigrate(args []string) error {
+	sub := "up"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+
+	fs := flag.NewFlagSet("migrate "+sub, flag.ExitOnError)
+	steps := 1
+	if sub == "down" {
+		fs.IntVar(&steps, "steps", 1, "取り消すマイグレーションの数")
+	}
+	fs.Parse(args)
+
+	switch sub {
+	case "up", "down", "status":
+	default:
+		return fmt.Errorf("不明なサブコマンドです: migrate %s\n%s", sub, migrateUsage)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "up":
+		applied, err := dbmanager.MigrateUp(db)
+		for _, m := range applied {
+			log.Printf("マイグレーションを適用しました: %03d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("マイグレーションが完了しました (適用: %d件)", len(applied))
+	case "down":
+		reverted, err := dbmanager.MigrateDown(db, steps)
+		for _, m := range reverted {
+			log.Printf("マイグレーションを取り消しました: %03d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	case "status":
+		states, err := dbmanager.MigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, state := range states {
+			fmt.Fprintf(w, "%03d\t%s\t%s\n", state.Version, state.Name, formatTime(state.AppliedAt))
+		}
+		return w.Flush()
+	}
+	return nil
+}
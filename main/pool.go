@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"go-rss-sql/dbmanager"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// fetchPool は全体の同時取得数とホストごとの同時取得数を制限してフィードを取得する
+type fetchPool struct {
+	workers int
+	perHost int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newFetchPool(workers, perHost int) *fetchPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if perHost < 1 {
+		perHost = 1
+	}
+	return &fetchPool{workers: workers, perHost: perHost, hosts: make(map[string]chan struct{})}
+}
+
+// run はfeedsを取得し、結果を順不同でチャネルへ送る。すべて完了するとチャネルは閉じられる。
+// ctxがキャンセルされると新たな取得は開始せず、取得中のフィードの結果のみを送る
+func (p *fetchPool) run(ctx context.Context, feeds []dbmanager.Feed, fetch func(feed dbmanager.Feed) FeedResult) <-chan FeedResult {
+	jobs := make(chan dbmanager.Feed)
+	results := make(chan FeedResult, p.workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for feed := range jobs {
+				sem := p.hostSemaphore(feed.URL)
+				sem <- struct{}{}
+				result := fetch(feed)
+				<-sem
+				results <- result
+			}
+		}()
+	}
+
+	go func() {
+	dispatch:
+		for _, feed := range interleaveByHost(feeds) {
+			select {
+			case jobs <- feed:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+func (p *fetchPool) hostSemaphore(feedURL string) chan struct{} {
+	key := hostKey(feedURL)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sem, ok := p.hosts[key]
+	if !ok {
+		sem = make(chan struct{}, p.perHost)
+		p.hosts[key] = sem
+	}
+	return sem
+}
+
+// hostKey は同時接続数を数える単位を返す。
+// *.blogterest.netのようなサブドメイン違いのブログは同じサーバーとみなす
+func hostKey(feedURL string) string {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Hostname() == "" {
+		return feedURL
+	}
+	host := strings.ToLower(u.Hostname())
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// interleaveByHost は同じホストのURLが連続しないように並べ替える。
+// ワーカーが同一ホストのセマフォ待ちで詰まるのを避けるため
+func interleaveByHost(feeds []dbmanager.Feed) []dbmanager.Feed {
+	var order []string
+	groups := make(map[string][]dbmanager.Feed)
+	for _, feed := range feeds {
+		key := hostKey(feed.URL)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], feed)
+	}
+
+	result := make([]dbmanager.Feed, 0, len(feeds))
+	for len(result) < len(feeds) {
+		for _, key := range order {
+			if group := groups[key]; len(group) > 0 {
+				result = append(result, group[0])
+				groups[key] = group[1:]
+			}
+		}
+	}
+	return result
+}
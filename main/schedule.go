@@ -0,0 +1,135 @@
+package main
+
+import (
+	"go-rss-sql/config"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+)
+
+// hintTranslator はgofeed.Feedに含まれないRSSの<ttl>をCustom["ttl"]へ残す
+type hintTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+func (t *hintTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+	if rssFeed, ok := feed.(*rss.Feed); ok && rssFeed.TTL != "" {
+		if result.Custom == nil {
+			result.Custom = make(map[string]string)
+		}
+		result.Custom["ttl"] = rssFeed.TTL
+	}
+	return result, nil
+}
+
+// nextPollInterval は取得結果から次回までの取得間隔を決める。
+// 記事の投稿間隔の中央値を基本とし、フィードのttlやsy:updatePeriodの指定より短くはしない
+func nextPollInterval(feedResult FeedResult, dc config.DaemonConfig) time.Duration {
+	prev := time.Duration(feedResult.Source.PollIntervalSeconds) * time.Second
+	if prev <= 0 {
+		prev = dc.DefaultInterval
+	}
+
+	var interval time.Duration
+	switch {
+	case feedResult.Err != nil:
+		// 失敗時の間隔はバックオフ側で管理する
+		interval = prev
+	case feedResult.NotModified:
+		interval = prev * 3 / 2
+	default:
+		interval = estimateUpdateInterval(feedResult.Feed)
+		if interval <= 0 {
+			interval = prev * 3 / 2
+		}
+		if hint := publisherHint(feedResult.Feed); hint > interval {
+			interval = hint
+		}
+	}
+
+	if interval < dc.MinInterval {
+		interval = dc.MinInterval
+	}
+	if interval > dc.MaxInterval {
+		interval = dc.MaxInterval
+	}
+	return interval
+}
+
+// estimateUpdateInterval は直近の記事の公開日時の間隔の中央値を返す。算出できない場合は0
+func estimateUpdateInterval(feed *gofeed.Feed) time.Duration {
+	var times []time.Time
+	for _, item := range feed.Items {
+		switch {
+		case item.PublishedParsed != nil:
+			times = append(times, *item.PublishedParsed)
+		case item.UpdatedParsed != nil:
+			times = append(times, *item.UpdatedParsed)
+		}
+	}
+	if len(times) < 2 {
+		return 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	if len(times) > 11 {
+		times = times[:11]
+	}
+
+	gaps := make([]time.Duration, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		if gap := times[i-1].Sub(times[i]); gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return 0
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+// publisherHint はフィード側が指定する最小の取得間隔を返す
+func publisherHint(feed *gofeed.Feed) time.Duration {
+	var hint time.Duration
+	if ttl, err := strconv.Atoi(feed.Custom["ttl"]); err == nil && ttl > 0 {
+		hint = time.Duration(ttl) * time.Minute
+	}
+
+	sy := feed.Extensions["sy"]
+	if sy == nil || len(sy["updatePeriod"]) == 0 {
+		return hint
+	}
+	var period time.Duration
+	switch strings.TrimSpace(sy["updatePeriod"][0].Value) {
+	case "hourly":
+		period = time.Hour
+	case "daily":
+		period = 24 * time.Hour
+	case "weekly":
+		period = 7 * 24 * time.Hour
+	case "monthly":
+		period = 30 * 24 * time.Hour
+	case "yearly":
+		period = 365 * 24 * time.Hour
+	default:
+		return hint
+	}
+	frequency := 1
+	if f := sy["updateFrequency"]; len(f) > 0 {
+		if n, err := strconv.Atoi(strings.TrimSpace(f[0].Value)); err == nil && n > 0 {
+			frequency = n
+		}
+	}
+	if d := period / time.Duration(frequency); d > hint {
+		hint = d
+	}
+	return hint
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-rss-sql/dbmanager"
+	"os"
+	"text/tabwriter"
+)
+
+func runTags(args []string) error {
+	fs := flag.NewFlagSet("tags", flag.ExitOnError)
+	limit := fs.Int("limit", 50, "表示する最大件数")
+	fs.Parse(args)
+
+	db, err := openMigratedDB()
+	if err != nil {
+		return err
+	}
+
+	counts, err := dbmanager.GetTagCounts(db, *limit)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COUNT\tTAG")
+	for _, c := range counts {
+		fmt.Fprintf(w, "%d\t%s\n", c.Count, c.Name)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,170 @@
+package opml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Document はOPML 2.0の文書
+type Document struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    Head     `xml:"head"`
+	Body    Body     `xml:"body"`
+}
+
+type Head struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type Body struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+// Outline はフィード (xmlUrlあり) またはフォルダ (子のoutlineを持つ) を表す。
+// enabledはこのツール独自の属性で、他のリーダーでは無視される
+type Outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	Category string    `xml:"category,attr,omitempty"`
+	Enabled  string    `xml:"enabled,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// Entry はOPMLに含まれる1件のフィード
+type Entry struct {
+	URL     string
+	Title   string
+	SiteURL string
+	// フォルダの階層を"/"で連結したもの。フォルダがなければcategory属性の最初の値を使う
+	Group   string
+	Enabled bool
+}
+
+// Parse はOPMLを読み込み、含まれるフィードを文書順に返す
+func Parse(r io.Reader) ([]Entry, error) {
+	var doc Document
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("OPMLの解析に失敗しました: %w", err)
+	}
+	var entries []Entry
+	collect(doc.Body.Outlines, nil, &entries)
+	return entries, nil
+}
+
+func collect(outlines []Outline, folders []string, entries *[]Entry) {
+	for _, o := range outlines {
+		if o.XMLURL == "" {
+			name := firstNonEmpty(o.Title, o.Text)
+			collect(o.Outlines, append(folders[:len(folders):len(folders)], name), entries)
+			continue
+		}
+		group := strings.Join(folders, "/")
+		if group == "" {
+			group = firstCategory(o.Category)
+		}
+		*entries = append(*entries, Entry{
+			URL:     strings.TrimSpace(o.XMLURL),
+			Title:   firstNonEmpty(o.Title, o.Text),
+			SiteURL: o.HTMLURL,
+			Group:   group,
+			Enabled: !strings.EqualFold(o.Enabled, "false"),
+		})
+		// フィードの下に置かれたoutlineもフィードとして扱う
+		collect(o.Outlines, folders, entries)
+	}
+}
+
+// firstCategory はcategory属性 ("/A/B,/C" 形式) の最初の値をフォルダの階層として返す
+func firstCategory(category string) string {
+	first := strings.TrimSpace(strings.Split(category, ",")[0])
+	return strings.Trim(first, "/")
+}
+
+// Write はentriesをグループごとのフォルダにまとめたOPML 2.0として書き出す
+func Write(w io.Writer, title string, entries []Entry) error {
+	root := &folder{}
+	for _, e := range entries {
+		f := root
+		if e.Group != "" {
+			for _, name := range strings.Split(e.Group, "/") {
+				f = f.child(name)
+			}
+		}
+		text := firstNonEmpty(e.Title, e.URL)
+		f.outlines = append(f.outlines, Outline{
+			Text:    text,
+			Title:   text,
+			Type:    "rss",
+			XMLURL:  e.URL,
+			HTMLURL: e.SiteURL,
+			Enabled: fmt.Sprint(e.Enabled),
+		})
+	}
+
+	doc := Document{
+		Version: "2.0",
+		Head:    Head{Title: title, DateCreated: time.Now().Format(time.RFC1123Z)},
+		Body:    Body{Outlines: root.build()},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("OPMLの書き出しに失敗しました: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// folder はOPMLを書き出すためのフォルダの木
+type folder struct {
+	children map[string]*folder
+	outlines []Outline
+}
+
+func (f *folder) child(name string) *folder {
+	if f.children == nil {
+		f.children = make(map[string]*folder)
+	}
+	c, ok := f.children[name]
+	if !ok {
+		c = &folder{}
+		f.children[name] = c
+	}
+	return c
+}
+
+// build はフォルダを名前順に並べ、その後にフォルダ直下のフィードを並べる
+func (f *folder) build() []Outline {
+	names := make([]string, 0, len(f.children))
+	for name := range f.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	outlines := make([]Outline, 0, len(names)+len(f.outlines))
+	for _, name := range names {
+		outlines = append(outlines, Outline{Text: name, Title: name, Outlines: f.children[name].build()})
+	}
+	return append(outlines, f.outlines...)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package opml
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		opml    string
+		want    []Entry
+		wantErr bool
+	}{
+		{
+			name: "flat",
+			opml: `<opml version="2.0"><body>
+				<outline text="A" xmlUrl=" https://a.example.com/feed/ " htmlUrl="https://a.example.com/"/>
+				<outline title="B" text="b" xmlUrl="https://b.example.com/feed/" enabled="false"/>
+			</body></opml>`,
+			want: []Entry{
+				{URL: "https://a.example.com/feed/", Title: "A", SiteURL: "https://a.example.com/", Enabled: true},
+				{URL: "https://b.example.com/feed/", Title: "B", Enabled: false},
+			},
+		},
+		{
+			name: "nested folders",
+			opml: `<opml version="1.0"><body>
+				<outline text="News"><outline text="Tech">
+					<outline text="C" xmlUrl="https://c.example.com/rss"/>
+				</outline></outline>
+				<outline text="D" xmlUrl="https://d.example.com/rss" enabled="FALSE"/>
+			</body></opml>`,
+			want: []Entry{
+				{URL: "https://c.example.com/rss", Title: "C", Group: "News/Tech", Enabled: true},
+				{URL: "https://d.example.com/rss", Title: "D", Enabled: false},
+			},
+		},
+		{
+			name: "category attribute",
+			opml: `<opml version="2.0"><body>
+				<outline text="E" xmlUrl="https://e.example.com/rss" category="/Blogs/Go,/Other"/>
+			</body></opml>`,
+			want: []Entry{{URL: "https://e.example.com/rss", Title: "E", Group: "Blogs/Go", Enabled: true}},
+		},
+		{
+			name:    "broken xml",
+			opml:    `<opml><body><outline`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.opml))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{URL: "https://a.example.com/feed/", Title: "A & B", SiteURL: "https://a.example.com/", Enabled: true},
+		{URL: "https://b.example.com/feed/", Group: "News/Tech", Enabled: false},
+		{URL: "https://c.example.com/feed/", Title: "C", Group: "News", Enabled: true},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, "feeds", entries); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "<?xml") || !strings.Contains(out, `<opml version="2.0">`) {
+		t.Errorf("Write() output does not start with an OPML 2.0 document:\n%s", out)
+	}
+
+	got, err := Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	// フォルダを名前順に並べ、その後にフォルダ直下のフィードを並べる
+	want := []Entry{
+		{URL: "https://b.example.com/feed/", Title: "https://b.example.com/feed/", Group: "News/Tech", Enabled: false},
+		{URL: "https://c.example.com/feed/", Title: "C", Group: "News", Enabled: true},
+		{URL: "https://a.example.com/feed/", Title: "A & B", SiteURL: "https://a.example.com/", Enabled: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(Write()) = %+v, want %+v", got, want)
+	}
+}
@@ -1,18 +1,19 @@
 package rssList
 
-// 分割処理用
-func GetSegment(index int, totalSegments int) []string {
-	segmentSize := len(Rss_urls) / totalSegments
-	start := index * segmentSize
-	end := (index + 1) * segmentSize
+import "hash/fnv"
 
-	if index == totalSegments-1 {
-		return Rss_urls[start:]
-	} else {
-		return Rss_urls[start:end]
+// ShardOf はURLが属するシャード番号を返す。分割処理用。URLのハッシュでシャードを決めるため、
+// リストの増減や並び順に関わらず同じURLは常に同じシャードに割り当てられる
+func ShardOf(url string, totalSegments int) int {
+	if totalSegments <= 1 {
+		return 0
 	}
+	h := fnv.New32a()
+	h.Write([]byte(url))
+	return int(h.Sum32() % uint32(totalSegments))
 }
 
+// feedsテーブルが空のときの初期登録に使用する。以降の追加・無効化はfeedsテーブルで行う
 var Rss_urls = []string{
 
 	"http://uretarest.blogterest.net/feed/",
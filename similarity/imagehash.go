@@ -0,0 +1,58 @@
+package similarity
+
+import "image"
+
+// ImageHash は画像の知覚ハッシュ (dHash) を返す。画像を9x8の輝度に縮小し、横に隣り合う画素の明暗を64ビットに並べる。
+// 再圧縮や縮小された同じ画像は近い値になる
+func ImageHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	bounds := img.Bounds()
+	if bounds.Dx() < 1 || bounds.Dy() < 1 {
+		return 0
+	}
+
+	var gray [h][w]float64
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			gray[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	bit := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			if gray[y][x] < gray[y][x+1] {
+				hash |= 1 << uint(bit)
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+// averageLuma は矩形内の平均輝度を返す。大きな画像でも速いよう、1辺最大16点を間引いて数える
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	stepX := (x1 - x0 + 15) / 16
+	stepY := (y1 - y0 + 15) / 16
+	var sum float64
+	n := 0
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,108 @@
+package similarity
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// shingleSize は文字単位のシングルの長さ。日本語のタイトルは単語の区切りがないため文字n-gramを使う
+const shingleSize = 3
+
+// maxDescriptionRunes はSimHashに使う説明文の長さの上限。末尾の定型文の影響を抑える
+const maxDescriptionRunes = 200
+
+var folder = cases.Fold()
+
+// TextHash はタイトルと説明文 (HTML可) からSimHashを計算する。タイトルの特徴は説明文の2倍の重みで数える。
+// 特徴が1つもない場合は0を返す
+func TextHash(title, description string) uint64 {
+	var weights [64]int
+	features := 0
+	add := func(text string, weight int) {
+		for _, shingle := range Shingles(text) {
+			h := hash64(shingle)
+			for i := 0; i < 64; i++ {
+				if h&(1<<uint(i)) != 0 {
+					weights[i] += weight
+				} else {
+					weights[i] -= weight
+				}
+			}
+			features++
+		}
+	}
+	add(title, 2)
+	description = StripTags(description)
+	if runes := []rune(description); len(runes) > maxDescriptionRunes {
+		description = string(runes[:maxDescriptionRunes])
+	}
+	add(description, 1)
+	if features == 0 {
+		return 0
+	}
+
+	var simhash uint64
+	for i, w := range weights {
+		if w > 0 {
+			simhash |= 1 << uint(i)
+		}
+	}
+	return simhash
+}
+
+// Shingles はテキストを正規化し、文字・数字のみを残した文字n-gramの一覧を返す。
+// n文字に満たない場合はテキスト全体を1つのシングルとする
+func Shingles(text string) []string {
+	var runes []rune
+	for _, r := range folder.String(norm.NFKC.String(text)) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			runes = append(runes, r)
+		}
+	}
+	if len(runes) == 0 {
+		return nil
+	}
+	if len(runes) <= shingleSize {
+		return []string{string(runes)}
+	}
+	shingles := make([]string, 0, len(runes)-shingleSize+1)
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		shingles = append(shingles, string(runes[i:i+shingleSize]))
+	}
+	return shingles
+}
+
+// Distance は2つのハッシュのハミング距離を返す
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// StripTags はHTMLからテキストのみを取り出す
+func StripTags(s string) string {
+	if !strings.Contains(s, "<") {
+		return html.UnescapeString(s)
+	}
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			b.Write(z.Text())
+			b.WriteByte(' ')
+		}
+	}
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -12,7 +12,16 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-func UploadToS3(s3AccessKey, s3SecretKey, bucketName, objectKey string, data []byte) (string, error) {
+// Options はアップロード先のS3バケットと配信用CDNの設定
+type Options struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	Bucket          string
+	CDNHost         string
+}
+
+func UploadToS3(opts Options, objectKey string, data []byte) (string, error) {
 	// ログファイルを開く
 	logFile, err := os.OpenFile("./uploader.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
@@ -27,8 +36,8 @@ func UploadToS3(s3AccessKey, s3SecretKey, bucketName, objectKey string, data []b
 
 	// セッションを作成
 	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String("ap-northeast-1"), // ご自身のAWSリージョンに合わせて変更してください
-		Credentials: credentials.NewStaticCredentials(s3AccessKey, s3SecretKey, ""),
+		Region:      aws.String(opts.Region),
+		Credentials: credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, ""),
 	})
 	if err != nil {
 		logger.Println("AWSセッションの作成エラー:", err)
@@ -40,7 +49,7 @@ func UploadToS3(s3AccessKey, s3SecretKey, bucketName, objectKey string, data []b
 
 	// ファイルをアップロード
 	_, err = svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
+		Bucket: aws.String(opts.Bucket),
 		Key:    aws.String(objectKey),
 		Body:   bytes.NewReader(data),
 	})
@@ -51,6 +60,6 @@ func UploadToS3(s3AccessKey, s3SecretKey, bucketName, objectKey string, data []b
 	logger.Println("S3へのアップロード成功")
 
 	// CloudFrontのURLを生成（直接のS3 URLの代わりに）
-	objectURL := fmt.Sprintf("https://dr3jjw5otuz25.cloudfront.net/%s", objectKey)
+	objectURL := fmt.Sprintf("https://%s/%s", opts.CDNHost, objectKey)
 	return objectURL, nil
 }
@@ -0,0 +1,114 @@
+package urlnorm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+)
+
+// maxPageBytes は<link rel=canonical>を探すために読み込むページの上限
+const maxPageBytes = 512 * 1024
+
+// CanonicalFromHTML はHTMLの<head>内にある<link rel="canonical">のURLを、pageURLを基準に絶対URLにして返す
+func CanonicalFromHTML(r io.Reader, pageURL string) (string, bool) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", false
+	}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return "", false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if token.Data == "body" {
+				return "", false
+			}
+			if token.Data != "link" {
+				continue
+			}
+			var rel, href string
+			for _, a := range token.Attr {
+				switch strings.ToLower(a.Key) {
+				case "rel":
+					rel = strings.ToLower(a.Val)
+				case "href":
+					href = strings.TrimSpace(a.Val)
+				}
+			}
+			if href == "" || !containsWord(rel, "canonical") {
+				continue
+			}
+			ref, err := url.Parse(href)
+			if err != nil {
+				return "", false
+			}
+			return base.ResolveReference(ref).String(), true
+		}
+	}
+}
+
+func containsWord(list, word string) bool {
+	for _, w := range strings.Fields(list) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver は記事ページを取得して<link rel=canonical>を反映した正規のURLを求める
+type Resolver struct {
+	Client *http.Client
+}
+
+func NewResolver(timeout time.Duration) *Resolver {
+	return &Resolver{Client: &http.Client{Timeout: timeout}}
+}
+
+// Resolve はlinkのページに同じサイト内のcanonicalが指定されていればそれを、なければlinkを正規化して返す。
+// 他サイトを指すcanonicalは採用しない
+func (r *Resolver) Resolve(link string) (string, error) {
+	canonical := Canonicalize(link)
+	resp, err := r.Client.Get(link)
+	if err != nil {
+		return canonical, fmt.Errorf("記事ページの取得に失敗しました: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return canonical, fmt.Errorf("記事ページが非200ステータスを返しました: %d", resp.StatusCode)
+	}
+
+	found, ok := CanonicalFromHTML(io.LimitReader(resp.Body, maxPageBytes), resp.Request.URL.String())
+	if !ok || !sameSite(found, link) {
+		return canonical, nil
+	}
+	return Canonicalize(found), nil
+}
+
+func sameSite(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	da, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(ua.Hostname()))
+	if err != nil {
+		return false
+	}
+	db, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(ub.Hostname()))
+	if err != nil {
+		return false
+	}
+	return da == db
+}
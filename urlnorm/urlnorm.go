@@ -0,0 +1,118 @@
+package urlnorm
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// trackingParams は記事の内容に関係なく付与される計測用のクエリパラメータ
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"yclid":   true,
+	"msclkid": true,
+	"igshid":  true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_ga":     true,
+	"_gl":     true,
+	"ref_src": true,
+	"amp":     true,
+}
+
+// valuelessParamHosts は値のないクエリ (?sp, ?xml, ?all など) が表示切り替えにしか使われないブログサービス
+var valuelessParamHosts = []string{
+	".fc2.com",
+	".2nt.com",
+	".blog.jp",
+	".doorblog.jp",
+	".livedoor.blog",
+}
+
+// Canonicalize はアイテムのリンクを正規化する。スキームとホストを小文字にし、既定のポート・フラグメント・
+// 計測用パラメータを取り除き、残ったパラメータを名前順に並べる。解析できないURLはそのまま返す
+func Canonicalize(raw string) string {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = host + ":" + port
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = cleanQuery(u.RawQuery, dropsValuelessParams(host))
+	return u.String()
+}
+
+// Key は重複判定に使うキーを返す。Canonicalizeに加えて、http/httpsの違い、先頭のwww.、
+// パス末尾のスラッシュを無視する
+func Key(raw string) string {
+	canonical := Canonicalize(raw)
+	u, err := url.Parse(canonical)
+	if err != nil || u.Host == "" {
+		return canonical
+	}
+	u.Host = strings.TrimPrefix(u.Host, "www.")
+	if len(u.Path) > 1 {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = ""
+	}
+	u.Scheme = ""
+	return strings.TrimPrefix(u.String(), "//")
+}
+
+func dropsValuelessParams(host string) bool {
+	for _, suffix := range valuelessParamHosts {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanQuery(rawQuery string, dropValueless bool) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name := pair
+		hasValue := false
+		if i := strings.Index(pair, "="); i >= 0 {
+			name = pair[:i]
+			hasValue = true
+		}
+		key, err := url.QueryUnescape(name)
+		if err != nil {
+			key = name
+		}
+		key = strings.ToLower(key)
+		if trackingParams[key] || strings.HasPrefix(key, "utm_") {
+			continue
+		}
+		if dropValueless && !hasValue {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	sort.Strings(kept)
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,58 @@
+package urlnorm
+
+import "testing"
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"HTTPS://Example.COM:443/Posts/1#comments", "https://example.com/Posts/1"},
+		{"http://example.com:80", "http://example.com/"},
+		{"http://example.com:8080/a", "http://example.com:8080/a"},
+		{"https://example.com/a?utm_source=rss&b=2&a=1&fbclid=x", "https://example.com/a?a=1&b=2"},
+		{"https://example.com/a?UTM_Medium=feed", "https://example.com/a"},
+		{"https://example.com/a?sp", "https://example.com/a?sp"},
+		{"https://blog.fc2.com/a?sp&no=3", "https://blog.fc2.com/a?no=3"},
+		{"  https://example.com/a  ", "https://example.com/a"},
+		{"/relative/path", "/relative/path"},
+		{"not a url", "not a url"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Canonicalize(tt.raw); got != tt.want {
+			t.Errorf("Canonicalize(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"https://www.example.com/posts/1/", "example.com/posts/1"},
+		{"http://example.com/posts/1?utm_campaign=x#top", "example.com/posts/1"},
+		{"https://example.com/", "example.com/"},
+		{"https://example.com", "example.com/"},
+		{"https://example.com/a?b=2&a=1", "example.com/a?a=1&b=2"},
+		{"tag:example.com,2024:1", "tag:example.com,2024:1"},
+	}
+	for _, tt := range tests {
+		if got := Key(tt.raw); got != tt.want {
+			t.Errorf("Key(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	// 同じ記事を指すリンクは同じキーになる
+	same := []string{
+		"https://www.example.com/posts/1",
+		"http://example.com/posts/1/",
+		"https://EXAMPLE.com:443/posts/1?utm_source=feed#more",
+	}
+	for _, raw := range same[1:] {
+		if Key(raw) != Key(same[0]) {
+			t.Errorf("Key(%q) = %q, want %q", raw, Key(raw), Key(same[0]))
+		}
+	}
+}